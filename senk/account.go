@@ -0,0 +1,146 @@
+// account page
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type accountData struct {
+	Tokens        []Token
+	NewToken      string // shown once, right after it's created
+	TwoFactor     bool   // whether two-factor authentication is enabled
+	RecoveryLeft  int    // number of unused recovery codes
+	Enrollment    *totpEnrollment
+	RecoveryCodes []string // shown once, right after they're generated
+	Admin         bool     // whether the user can open the admin page
+	External      bool     // signs in with an identity provider, confirms the deletion with the username
+	GraceDays     int      // days until the data of a deleted account is purged
+}
+
+// renderAccountPage renders the account page of the signed in user. The page must have the username.
+func (db *Database) renderAccountPage(w http.ResponseWriter, p page, account accountData, status int) {
+	p.Title = "Account"
+	p.Heading = "Account"
+	p.View = "account-view"
+	account.Tokens = db.Tokens.GetUserTokens(p.Username)
+	account.Admin = db.Users.IsAdmin(p.Username)
+	if user, err := db.Users.GetUser(p.Username); err == nil {
+		account.External = user.PasswordHash == ""
+	}
+	account.GraceDays = int(GetConfig().DeletionGracePeriod.Hours() / 24)
+	var err error
+	account.TwoFactor, account.RecoveryLeft, account.Enrollment, err = db.Users.GetTOTPStatus(p.Username)
+	if err != nil {
+		slog.Error("Error getting two-factor authentication status", "username", p.Username, "err", err)
+	}
+	p.Account = &account
+	p.render(w, status)
+}
+
+func (db *Database) serveAccountPage(w http.ResponseWriter, r *http.Request) {
+	p := newPage(r, "account-view")
+	if p.Username == "" {
+		serveLogin(w, r)
+		return
+	}
+	db.renderAccountPage(w, p, accountData{}, http.StatusOK)
+}
+
+// createToken creates an API token from the form values "name", "scope", "notes" (separated
+// by whitespace or commas) and "expires" (number of days, empty if the token doesn't expire).
+func (db *Database) createToken(w http.ResponseWriter, r *http.Request) {
+	p := newPage(r, "account-view")
+	if p.Username == "" {
+		http.Error(w, "Only authenticated users can create tokens", http.StatusForbidden)
+		return
+	}
+
+	var expires time.Time
+	if days := strings.TrimSpace(r.PostFormValue("expires")); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 || n > 3650 {
+			p.Error = "Expiry must be a number of days between 1 and 3650"
+			db.renderAccountPage(w, p, accountData{}, http.StatusBadRequest)
+			return
+		}
+		expires = time.Now().AddDate(0, 0, n)
+	}
+	notes := strings.FieldsFunc(r.PostFormValue("notes"), func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+	})
+
+	secret, _, err := db.Tokens.Create(p.Username, r.PostFormValue("name"), r.PostFormValue("scope"), notes, expires)
+	if err != nil {
+		p.Error = err.Error()
+		db.renderAccountPage(w, p, accountData{}, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	db.renderAccountPage(w, p, accountData{NewToken: secret}, http.StatusOK)
+}
+
+// revokeToken revokes the token and redirects to the account page.
+// expects following chi URL params: token
+func (db *Database) revokeToken(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can revoke tokens", http.StatusForbidden)
+		return
+	}
+
+	err := db.Tokens.Revoke(session.Data.Username, chi.URLParam(r, "token"))
+	if errors.Is(err, ErrNotExist) {
+		http.Error(w, "Token does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error revoking token", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// totpAction returns a handler for a form changing the signed in user's two-factor authentication.
+// The action gets the "code" form value and can return new recovery codes to show.
+func (db *Database) totpAction(action func(username, code string) ([]string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := newPage(r, "account-view")
+		if p.Username == "" {
+			http.Error(w, "Only authenticated users can change two-factor authentication", http.StatusForbidden)
+			return
+		}
+
+		codes, err := action(p.Username, r.PostFormValue("code"))
+		if errors.Is(err, ErrInvalidCode) || errors.Is(err, ErrTOTPEnabled) || errors.Is(err, ErrTOTPNotEnabled) || errors.Is(err, ErrTOTPNotStarted) {
+			p.Error = err.Error()
+			db.renderAccountPage(w, p, accountData{}, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Error changing two-factor authentication", "err", err)
+			p.Error = "Undefined error"
+			db.renderAccountPage(w, p, accountData{}, http.StatusInternalServerError)
+			return
+		}
+		if codes != nil {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		db.renderAccountPage(w, p, accountData{RecoveryCodes: codes}, http.StatusOK)
+	}
+}
+
+func (db *Database) beginTOTP(username, _ string) ([]string, error) {
+	return nil, db.Users.BeginTOTP(username)
+}
+
+func (db *Database) disableTOTP(username, code string) ([]string, error) {
+	return nil, db.Users.DisableTOTP(username, code)
+}
@@ -0,0 +1,236 @@
+// admin dashboard and user management
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var ErrSelfAdmin = errors.New("administrators can't disable, demote or delete themselves")
+
+// byteSize is printed in binary units, for example "1.5 MiB".
+type byteSize int64
+
+func (b byteSize) String() string {
+	if b < 1024 {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(1024), 0
+	for n := int64(b) / 1024; n >= 1024; n /= 1024 {
+		div *= 1024
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+type adminUser struct {
+	Username    string
+	Role        string
+	Disabled    bool
+	External    bool   // doesn't have a password
+	Subject     string // identity provider subject the user is linked to
+	TwoFactor   bool
+	Sessions    int
+	Notes       int
+	Trash       int
+	NotesSize   byteSize // size of the user's store, including the history
+	Attachments byteSize
+}
+
+type adminData struct {
+	Users   []adminUser
+	Deleted []DeletedUser // archived until they're purged
+	Self    string        // signed in administrator, empty if authorized with the admin token
+	OIDC    bool          // whether users can be linked to the identity provider
+}
+
+// adminAuthorized returns true if the request has the configured admin bearer token,
+// or if the signed in user is an administrator.
+func (db *Database) adminAuthorized(r *http.Request) bool {
+	if hasBearerToken(r, GetConfig().AdminToken) {
+		return true
+	}
+	_, session := GetSessionCtx(r.Context())
+	return session.Data.Authenticated && db.Users.IsAdmin(session.Data.Username)
+}
+
+func (db *Database) renderAdminPage(w http.ResponseWriter, p page, status int) {
+	p.Title = "Administration"
+	p.Heading = "Administration"
+	p.View = "admin-view"
+	sessions := db.Sessions.CountUserSessions()
+	sizes := db.StoreSizes()
+	admin := adminData{Self: p.Username, Deleted: db.Deletions.GetAll(), OIDC: GetConfig().OIDC.Enabled()}
+	for _, u := range db.Users.GetAllUsers() {
+		notes, trash, attachments := db.Metadata.UserUsage(u.Username)
+		role := u.Role
+		if role == "" {
+			role = RoleUser
+		}
+		subject := ""
+		if u.OIDC != nil {
+			subject = u.OIDC.Subject
+		}
+		admin.Users = append(admin.Users, adminUser{
+			Username:    u.Username,
+			Role:        role,
+			Disabled:    u.Disabled,
+			External:    u.PasswordHash == "",
+			Subject:     subject,
+			TwoFactor:   u.TOTP != nil && u.TOTP.Enabled,
+			Sessions:    sessions[u.Username],
+			Notes:       notes,
+			Trash:       trash,
+			NotesSize:   byteSize(sizes[u.Username]),
+			Attachments: byteSize(attachments),
+		})
+	}
+	p.Admin = &admin
+	p.render(w, status)
+}
+
+func (db *Database) serveAdminPage(w http.ResponseWriter, r *http.Request) {
+	p := newPage(r, "admin-view")
+	if !db.adminAuthorized(r) {
+		if p.Username == "" {
+			serveLogin(w, r)
+			return
+		}
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	db.renderAdminPage(w, p, http.StatusOK)
+}
+
+// adminAction returns a handler for a form on the admin page. After a successful action,
+// it redirects back to the page, otherwise the page is shown with the error.
+func (db *Database) adminAction(action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !db.adminAuthorized(r) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+		p := newPage(r, "admin-view")
+
+		err := action(r)
+		if err == nil {
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
+			return
+		}
+		p.Error = err.Error()
+		switch {
+		case errors.Is(err, ErrNotExist):
+			db.renderAdminPage(w, p, http.StatusNotFound)
+		case errors.Is(err, ErrInvalidUsername), errors.Is(err, ErrExist), errors.Is(err, ErrPasswordLength),
+			errors.Is(err, ErrPasswordStrength), errors.Is(err, ErrInvalidRole), errors.Is(err, ErrSelfAdmin), errors.Is(err, ErrDeleted), errors.Is(err, ErrOIDCLinked), errors.Is(err, ErrOIDCDisabled):
+			db.renderAdminPage(w, p, http.StatusBadRequest)
+		default:
+			slog.ErrorContext(r.Context(), "Error managing user", "err", err)
+			p.Error = "Undefined error"
+			db.renderAdminPage(w, p, http.StatusInternalServerError)
+		}
+	}
+}
+
+// adminCreateUser creates a user from the form values "username", "password" and "admin".
+func (db *Database) adminCreateUser(r *http.Request) error {
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	if err := db.AddUser(username, r.PostFormValue("password")); err != nil {
+		return err
+	}
+	db.audit(r.Context(), AuditEntry{Action: AuditUserCreate, Target: username, Detail: "admin"})
+	if r.PostFormValue("admin") != "" {
+		return db.setRole(r, username, RoleAdmin)
+	}
+	return nil
+}
+
+// adminResetPassword sets the user's password to the "password" form value and signs them out.
+// expects following chi URL params: username
+func (db *Database) adminResetPassword(r *http.Request) error {
+	username := chi.URLParam(r, "username")
+	if err := db.Users.ResetPassword(username, r.PostFormValue("password")); err != nil {
+		return err
+	}
+	db.Sessions.InvalidateUserSessions(username)
+	db.audit(r.Context(), AuditEntry{Action: AuditPasswordChange, Target: username, Detail: "reset"})
+	return nil
+}
+
+// adminSetRole sets the user's role to the "role" form value.
+// expects following chi URL params: username
+func (db *Database) adminSetRole(r *http.Request) error {
+	return db.setRole(r, chi.URLParam(r, "username"), r.PostFormValue("role"))
+}
+
+func (db *Database) setRole(r *http.Request, username, role string) error {
+	if _, session := GetSessionCtx(r.Context()); username == session.Data.Username && role != RoleAdmin {
+		return ErrSelfAdmin
+	}
+	if err := db.Users.SetRole(username, role); err != nil {
+		return err
+	}
+	db.audit(r.Context(), AuditEntry{Action: AuditRoleChange, Target: username, Detail: role})
+	return nil
+}
+
+// adminSetDisabled returns an action disabling or enabling the user. Disabled users are signed out.
+// expects following chi URL params: username
+func (db *Database) adminSetDisabled(disabled bool) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		username := chi.URLParam(r, "username")
+		if _, session := GetSessionCtx(r.Context()); username == session.Data.Username && disabled {
+			return ErrSelfAdmin
+		}
+		if err := db.Users.SetDisabled(username, disabled); err != nil {
+			return err
+		}
+		action := AuditUserEnable
+		if disabled {
+			action = AuditUserDisable
+			db.Sessions.InvalidateUserSessions(username)
+		}
+		db.audit(r.Context(), AuditEntry{Action: action, Target: username})
+		return nil
+	}
+}
+
+// adminSignOut invalidates all sessions of the user.
+// expects following chi URL params: username
+func (db *Database) adminSignOut(r *http.Request) error {
+	username := chi.URLParam(r, "username")
+	if _, err := db.Users.GetUser(username); err != nil {
+		return err
+	}
+	n := db.Sessions.InvalidateUserSessions(username)
+	db.audit(r.Context(), AuditEntry{Action: AuditSessionsRevoke, Target: username, Detail: strconv.Itoa(n)})
+	return nil
+}
+
+// adminLinkOIDC links the user to the "subject" form value at the configured identity provider,
+// or removes the link if it's empty. The subjects of failed sign ins are recorded in the audit log.
+// expects following chi URL params: username
+func (db *Database) adminLinkOIDC(r *http.Request) error {
+	username := chi.URLParam(r, "username")
+	issuer := GetConfig().OIDC.Issuer
+	if issuer == "" {
+		return ErrOIDCDisabled
+	}
+	var identity *OIDCIdentity
+	subject := strings.TrimSpace(r.PostFormValue("subject"))
+	if subject != "" {
+		identity = &OIDCIdentity{Issuer: issuer, Subject: subject}
+	}
+	if err := db.Users.LinkOIDC(username, identity); err != nil {
+		return err
+	}
+	db.audit(r.Context(), AuditEntry{Action: AuditOIDCLink, Target: username, Detail: subject})
+	return nil
+}
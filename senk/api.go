@@ -3,11 +3,18 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -16,6 +23,39 @@ import (
 	"github.com/google/uuid"
 )
 
+// indexNotes returns the user's notes which the requester can see. The query may contain the parameters
+// "tag", to only list notes with the tag, and "folder", to only list the notes directly in the folder
+// (an empty value means the top level).
+func (db *Database) indexNotes(user, requester string, query url.Values) ([]Note, error) {
+	tag := ""
+	if t := query.Get("tag"); t != "" {
+		var err error
+		tag, err = NormalizeTag(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	inFolder := query.Has("folder")
+	folder := query.Get("folder")
+
+	// TODO: Sort by recency
+	allNotes := db.Metadata.GetUserNotes(user)
+	notes := []Note{}
+	for _, n := range allNotes {
+		if tag != "" && !n.Metadata.HasTag(tag) {
+			continue
+		}
+		if inFolder && n.Metadata.Folder != folder {
+			continue
+		}
+		if db.Metadata.GetPermissions(&n.Metadata, requester) != PermissionNone {
+			notes = append(notes, n)
+		}
+	}
+	return notes, nil
+}
+
 // use the optional chi URL param "user" to specify whose index to get
 // TODO: Test the parameter
 func (db *Database) getIndex(w http.ResponseWriter, r *http.Request) {
@@ -36,21 +76,19 @@ func (db *Database) getIndex(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// TODO: Sort by recency
-	allNotes := db.Metadata.GetUserNotes(user)
-	notes := []Note{}
-	for _, n := range allNotes {
-		if n.Metadata.GetPermissions(requester) != PermissionNone {
-			notes = append(notes, n)
-		}
+	notes, err := db.indexNotes(user, requester, r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	bytes, err := json.Marshal(notes)
 	if err != nil {
 		http.Error(w, "Couldn't marshal note index", http.StatusInternalServerError)
-		log.Printf("Error marshalling note index: %v", err)
+		slog.ErrorContext(r.Context(), "Error marshalling note index", "err", err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(bytes)
 }
 
@@ -65,7 +103,7 @@ func (db *Database) getTrash(w http.ResponseWriter, r *http.Request) {
 	/* TODO: Show shared documents in trash?
 		notes := []Note{}
 		for _, n := range allNotes {
-			if n.Metadata.GetPermissions(session.Data.Username) != PermissionNone {
+			if db.Metadata.GetPermissions(&n.Metadata, session.Data.Username) != PermissionNone {
 	    			notes = append(notes, n)
 			}
 		}*/
@@ -73,9 +111,10 @@ func (db *Database) getTrash(w http.ResponseWriter, r *http.Request) {
 	bytes, err := json.Marshal(notes)
 	if err != nil {
 		http.Error(w, "Couldn't marshal trash index", http.StatusInternalServerError)
-		log.Printf("Error marshalling trash index: %v", err)
+		slog.ErrorContext(r.Context(), "Error marshalling trash index", "err", err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(bytes)
 }
 
@@ -90,10 +129,12 @@ func (db *Database) readNote(w http.ResponseWriter, r *http.Request) {
 
 	respc := make(chan NoteReadResp)
 	db.storage.Reads <- NoteRead{
-		user:  session.Data.Username,
-		owner: user,
-		id:    note,
-		resp:  respc,
+		user:   session.Data.Username,
+		owner:  user,
+		id:     note,
+		ctx:    r.Context(),
+		queued: db.storage.enqueue(),
+		resp:   respc,
 	}
 
 	resp := <-respc
@@ -105,12 +146,58 @@ func (db *Database) readNote(w http.ResponseWriter, r *http.Request) {
 		return
 	} else if resp.err != nil {
 		http.Error(w, "Undefined error", http.StatusInternalServerError)
-		log.Printf("Error serving file read request: %v", resp.err)
+		slog.ErrorContext(r.Context(), "Error serving file read request", "err", resp.err)
 		return
 	}
+	// The content type must be explicit, otherwise it would be sniffed and a note could be served as HTML.
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte(resp.v))
 }
 
+// expects following chi URL params: user, id
+func (db *Database) renderNote(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		session.Data.Username = ""
+	}
+
+	content, err := db.readContent(r.Context(), session.Data.Username, user, note, false)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrNoAccess) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error serving note render request", "err", err)
+		return
+	}
+
+	body, err := RenderMarkdown(content, db.Metadata.GetNoteMeta(user, note).Links)
+	if err != nil {
+		http.Error(w, "Couldn't render note", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error rendering note", "owner", user, "id", note, "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body)
+}
+
+// serveNote serves the note's page or the raw markdown, depending on the Accept header.
+// expects following chi URL params: user, id
+func (db *Database) serveNote(w http.ResponseWriter, r *http.Request) {
+	switch preferredType(r, "text/html", "text/markdown", "text/plain") {
+	case "text/markdown", "text/plain":
+		db.readNote(w, r)
+	default:
+		db.serveNotePage(false)(w, r)
+	}
+}
+
 // expects following chi URL params: user, id
 func (db *Database) readTrashNote(w http.ResponseWriter, r *http.Request) {
 	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
@@ -126,6 +213,8 @@ func (db *Database) readTrashNote(w http.ResponseWriter, r *http.Request) {
 		owner:     user,
 		id:        note,
 		fromTrash: true,
+		ctx:       r.Context(),
+		queued:    db.storage.enqueue(),
 		resp:      respc,
 	}
 
@@ -138,9 +227,10 @@ func (db *Database) readTrashNote(w http.ResponseWriter, r *http.Request) {
 		return
 	} else if resp.err != nil {
 		http.Error(w, "Undefined error", http.StatusInternalServerError)
-		log.Printf("Error serving trash file read request: %v", resp.err)
+		slog.ErrorContext(r.Context(), "Error serving trash file read request", "err", resp.err)
 		return
 	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte(resp.v))
 }
 
@@ -157,7 +247,7 @@ func (db *Database) writeNote(w http.ResponseWriter, r *http.Request) {
 	bytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
-		log.Printf("Error serving note write request (couldn't read request body): %v", err)
+		slog.ErrorContext(r.Context(), "Error serving note write request, couldn't read request body", "err", err)
 		return
 	}
 
@@ -168,6 +258,8 @@ func (db *Database) writeNote(w http.ResponseWriter, r *http.Request) {
 		id:      note,
 		delete:  false,
 		content: string(bytes),
+		ctx:     r.Context(),
+		queued:  db.storage.enqueue(),
 		resp:    respc,
 	}
 
@@ -178,7 +270,7 @@ func (db *Database) writeNote(w http.ResponseWriter, r *http.Request) {
 		return
 	} else if err != nil {
 		http.Error(w, "Undefined error", http.StatusInternalServerError)
-		log.Printf("Error serving note write request: %v", err)
+		slog.ErrorContext(r.Context(), "Error serving note write request", "err", err)
 		return
 	}
 }
@@ -190,46 +282,32 @@ func (db *Database) createNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var id string
-	for i := 0; i < 10; i++ { // Retry in case of id collision, at most 10 times
-		id = uuid.NewString()
-
-		respc := make(chan error)
-		db.storage.Writes <- NoteWrite{
-			user:    session.Data.Username,
-			owner:   session.Data.Username,
-			id:      id,
-			create:  true,
-			delete:  false,
-			content: "",
-			resp:    respc,
-		}
-
-		err := <-respc
-
-		if errors.Is(err, ErrNoAccess) {
-			http.Error(w, "Insufficient permissions", http.StatusForbidden)
-			return
-		} else if errors.Is(err, ErrIdUsed) {
-			log.Printf("Note ID collision: ~%s/%s", session.Data.Username, id)
-			id = ""
-			continue
-		} else if err != nil {
-			http.Error(w, "Undefined error", http.StatusInternalServerError)
-			log.Printf("Error serving note delete request: %v", err)
+	folder := r.FormValue("folder")
+	if folder != "" {
+		if _, err := db.Metadata.GetFolder(session.Data.Username, folder); err != nil {
+			http.Error(w, "Folder does not exist", http.StatusBadRequest)
 			return
 		}
-		break
 	}
 
-	if id == "" {
+	id, err := db.NewNote(r.Context(), session.Data.Username, folder)
+	if errors.Is(err, ErrNoAccess) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	} else if errors.Is(err, ErrNoUniqueId) {
 		http.Error(w, "Couldn't assign unique note ID, try again.", http.StatusInternalServerError)
 		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error serving note create request", "err", err)
+		return
 	}
 
-	now := time.Now()
-	db.Metadata.SetNoteMeta(session.Data.Username, id, NoteMeta{session.Data.Username, PermissionNone, now, now, now, false})
-
+	if r.PostFormValue("redirect") != "" { // form submitted without javascript
+		http.Redirect(w, r, "/~"+session.Data.Username+"/"+id, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte(id))
 }
 
@@ -250,6 +328,8 @@ func (db *Database) deleteNote(w http.ResponseWriter, r *http.Request) {
 		id:      note,
 		delete:  true,
 		content: "",
+		ctx:     r.Context(),
+		queued:  db.storage.enqueue(),
 		resp:    respc,
 	}
 
@@ -260,9 +340,644 @@ func (db *Database) deleteNote(w http.ResponseWriter, r *http.Request) {
 		return
 	} else if err != nil {
 		http.Error(w, "Undefined error", http.StatusInternalServerError)
-		log.Printf("Error serving note delete request: %v", err)
+		slog.ErrorContext(r.Context(), "Error serving note delete request", "err", err)
+		return
+	}
+}
+
+// use the optional chi URL param "user" to specify whose tags to get
+func (db *Database) getTags(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	requester := ""
+	if session.Data.Authenticated {
+		requester = session.Data.Username
+	}
+
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	if user == "" {
+		if requester == "" {
+			http.Error(w, "Not authenticated", http.StatusForbidden)
+			return
+		}
+		user = requester
+	}
+
+	bytes, err := json.Marshal(db.Metadata.GetUserTags(user, requester))
+	if err != nil {
+		http.Error(w, "Couldn't marshal tags", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling tags", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// expects following chi URL params: user, id
+// The request body is a JSON array of tags, which replace the note's explicit tags.
+func (db *Database) setTags(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can edit notes", http.StatusForbidden)
+		return
+	}
+
+	if !db.Metadata.CheckPermission(user, note, session.Data.Username, PermissionWrite) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	var tags []string
+	if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db.Metadata.SetTags(user, note, tags)
+	db.audit(r.Context(), AuditEntry{Action: AuditNoteTags, Owner: user, Target: user + "/" + note, Detail: strings.Join(tags, " ")})
+}
+
+// renameTag renames the tag given in the "from" form value to the one in "to" in all of the user's notes,
+// rewriting the hashtags in their content. If the tag "to" is already used, the tags are merged.
+// All of the notes are read before anything is changed. If some of them can't be written, the rest is
+// still renamed and the response has the status 500, with a JSON object listing the ids of the failed notes.
+func (db *Database) renameTag(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can edit notes", http.StatusForbidden)
+		return
+	}
+	user := session.Data.Username
+
+	from, err1 := NormalizeTag(r.PostFormValue("from"))
+	to, err2 := NormalizeTag(r.PostFormValue("to"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "Invalid tag", http.StatusBadRequest)
+		return
+	}
+	if from == to {
+		return
+	}
+
+	rewritten := make(map[string]string)
+	for _, id := range db.Metadata.HashtaggedNotes(user, from) {
+		readc := make(chan NoteReadResp)
+		db.storage.Reads <- NoteRead{
+			user:      user,
+			owner:     user,
+			id:        id,
+			fromTrash: db.Metadata.IsDeleted(user, id),
+			ctx:       r.Context(),
+			queued:    db.storage.enqueue(),
+			resp:      readc,
+		}
+		read := <-readc
+		if read.err != nil {
+			http.Error(w, "Undefined error", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error reading note to rename tag", "owner", user, "id", id, "err", read.err)
+			return
+		}
+		rewritten[id] = ReplaceHashtag(read.v, from, to)
+	}
+
+	db.Metadata.RenameTag(user, from, to)
+	db.audit(r.Context(), AuditEntry{Action: AuditTagRename, Owner: user, Target: user, Detail: from + " " + to})
+	failed := []string{}
+	for id, content := range rewritten {
+		writec := make(chan error)
+		db.storage.Writes <- NoteWrite{
+			user:    user,
+			owner:   user,
+			id:      id,
+			content: content,
+			ctx:     r.Context(),
+			queued:  db.storage.enqueue(),
+			resp:    writec,
+		}
+		if err := <-writec; err != nil {
+			slog.ErrorContext(r.Context(), "Error writing note to rename tag", "owner", user, "id", id, "err", err)
+			failed = append(failed, id)
+		}
+	}
+	if len(failed) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct{ Failed []string }{failed})
+	}
+}
+
+// checkShares returns the shares without the entries which are to be inherited,
+// or an error if any of the users doesn't exist.
+func (db *Database) checkShares(owner string, shares map[string]PermissionLevel) (map[string]PermissionLevel, error) {
+	checked := make(map[string]PermissionLevel)
+	for u, p := range shares {
+		if p == PermissionInherit || u == owner {
+			continue
+		}
+		if _, err := db.Users.GetUser(u); err != nil {
+			return nil, fmt.Errorf("%w: \"%s\"", err, u)
+		}
+		checked[u] = p
+	}
+	return checked, nil
+}
+
+type PermissionSettings struct {
+	Public PermissionLevel
+	Shares map[string]PermissionLevel
+}
+
+// expects following chi URL params: user, id
+// The request body is a JSON object with the fields of PermissionSettings.
+func (db *Database) setNotePermissions(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated || session.Data.Username != user {
+		http.Error(w, "Only the owner can change the permissions", http.StatusForbidden)
+		return
+	}
+	if meta := db.Metadata.GetNoteMeta(user, note); meta.Owner != user {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var settings PermissionSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	shares, err := db.checkShares(user, settings.Shares)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db.Metadata.SetNotePermissions(user, note, settings.Public, shares)
+	db.audit(r.Context(), AuditEntry{Action: AuditNotePermissions, Owner: user, Target: user + "/" + note,
+		Detail: permissionsDetail(settings.Public, shares)})
+}
+
+// expects following chi URL params: user, id
+// The request body is the id of the folder, or empty to move the note to the top level.
+func (db *Database) moveNote(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated || session.Data.Username != user {
+		http.Error(w, "Only the owner can move notes", http.StatusForbidden)
+		return
+	}
+	if meta := db.Metadata.GetNoteMeta(user, note); meta.Owner != user {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	folder := strings.TrimSpace(string(bytes))
+	err = db.Metadata.MoveNote(user, note, folder)
+	if errors.Is(err, ErrFolderNotExist) || errors.Is(err, ErrFolderCycle) || errors.Is(err, ErrFolderDepth) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error moving note", "err", err)
+		return
+	}
+	// The note inherits the folder's permissions.
+	db.audit(r.Context(), AuditEntry{Action: AuditNoteMove, Owner: user, Target: user + "/" + note, Detail: folder})
+}
+
+// use the optional chi URL param "user" to specify whose folders to get
+// The "parent" query parameter selects the folder to browse (the top level by default),
+// and "all" lists all folders regardless of the parent.
+func (db *Database) getFolders(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	requester := ""
+	if session.Data.Authenticated {
+		requester = session.Data.Username
+	}
+
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	if user == "" {
+		if requester == "" {
+			http.Error(w, "Not authenticated", http.StatusForbidden)
+			return
+		}
+		user = requester
+	}
+
+	folders := db.Metadata.GetUserFolders(user, r.URL.Query().Get("parent"), requester, r.URL.Query().Has("all"))
+
+	bytes, err := json.Marshal(folders)
+	if err != nil {
+		http.Error(w, "Couldn't marshal folders", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling folders", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// createFolder expects the form values "name" and optionally "parent".
+func (db *Database) createFolder(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can create folders", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if err := CheckFolderName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := uuid.NewString()
+	err := db.Metadata.AddFolder(session.Data.Username, id, FolderMeta{
+		Owner:    session.Data.Username,
+		Name:     name,
+		Parent:   r.PostFormValue("parent"),
+		Public:   PermissionInherit,
+		Creation: time.Now(),
+	})
+	if errors.Is(err, ErrFolderNotExist) || errors.Is(err, ErrFolderDepth) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating folder", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(id))
+}
+
+// expects following chi URL params: user, folder
+// The request body is a JSON object with the fields "Name", "Parent", "Public" and "Shares".
+func (db *Database) updateFolder(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	id := chi.URLParam(r, "folder")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated || session.Data.Username != user {
+		http.Error(w, "Only the owner can change folders", http.StatusForbidden)
+		return
+	}
+
+	folder, err := db.Metadata.GetFolder(user, id)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var settings struct {
+		Name   string
+		Parent string
+		PermissionSettings
+	}
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	settings.Name = strings.TrimSpace(settings.Name)
+	if err := CheckFolderName(settings.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shares, err := db.checkShares(user, settings.Shares)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	permissionsChanged := folder.Public != settings.Public || !maps.Equal(folder.Shares, shares)
+	folder.Name = settings.Name
+	folder.Parent = settings.Parent
+	folder.Public = settings.Public
+	folder.Shares = shares
+	err = db.Metadata.SetFolder(user, id, folder)
+	if errors.Is(err, ErrFolderNotExist) || errors.Is(err, ErrFolderCycle) || errors.Is(err, ErrFolderDepth) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error updating folder", "err", err)
+		return
+	}
+	if permissionsChanged {
+		db.audit(r.Context(), AuditEntry{Action: AuditFolderPermissions, Owner: user, Target: user + "/" + id,
+			Detail: permissionsDetail(folder.Public, shares)})
+	}
+}
+
+// expects following chi URL params: user, folder
+// The notes and subfolders are moved to the parent folder.
+func (db *Database) deleteFolder(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	id := chi.URLParam(r, "folder")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated || session.Data.Username != user {
+		http.Error(w, "Only the owner can delete folders", http.StatusForbidden)
+		return
+	}
+
+	if err := db.Metadata.DeleteFolder(user, id); errors.Is(err, ErrFolderNotExist) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting folder", "err", err)
+		return
+	}
+	db.audit(r.Context(), AuditEntry{Action: AuditFolderDelete, Owner: user, Target: user + "/" + id})
+}
+
+// expects following chi URL params: user, id
+func (db *Database) getBacklinks(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		session.Data.Username = ""
+	}
+
+	if !db.Metadata.CheckPermission(user, note, session.Data.Username, PermissionRead) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	bytes, err := json.Marshal(db.Metadata.GetBacklinks(user, note, session.Data.Username))
+	if err != nil {
+		http.Error(w, "Couldn't marshal backlinks", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling backlinks", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// use the optional chi URL param "user" to only include the notes of that user
+func (db *Database) getGraph(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		session.Data.Username = ""
+	}
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+
+	bytes, err := json.Marshal(db.Metadata.GetGraph(user, session.Data.Username))
+	if err != nil {
+		http.Error(w, "Couldn't marshal link graph", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling link graph", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// expects following chi URL params: user, id
+func (db *Database) getAttachments(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		session.Data.Username = ""
+	}
+
+	if !db.Metadata.CheckPermission(user, note, session.Data.Username, PermissionRead) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	attachments := db.Metadata.GetNoteMeta(user, note).Attachments
+	if attachments == nil {
+		attachments = make(map[string]Attachment)
+	}
+	bytes, err := json.Marshal(attachments)
+	if err != nil {
+		http.Error(w, "Couldn't marshal attachments", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling attachments", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// expects following chi URL params: user, id, name
+func (db *Database) readAttachment(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	name := chi.URLParam(r, "name")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		session.Data.Username = ""
+	}
+
+	if !db.Metadata.CheckPermission(user, note, session.Data.Username, PermissionRead) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	a, err := db.Metadata.GetAttachment(user, note, name)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := db.storage.OpenBlob(a.Hash)
+	if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error opening attachment blob", "hash", a.Hash, "err", err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", attachmentDisposition(name, a.ContentType))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", "\""+a.Hash+"\"")
+	http.ServeContent(w, r, name, a.Created, f)
+}
+
+// uploadAttachment streams the request body into the blob store and attaches it to the note.
+// The content type is detected from the content and has to be one of AttachmentTypes.
+// expects following chi URL params: user, id, name
+func (db *Database) uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	name := chi.URLParam(r, "name")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can upload attachments", http.StatusForbidden)
+		return
+	}
+
+	if err := CheckAttachmentName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !db.Metadata.CheckPermission(user, note, session.Data.Username, PermissionWrite) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	if r.ContentLength > MaxAttachmentSize {
+		http.Error(w, "Attachment too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, MaxAttachmentSize))
+	head, _ := body.Peek(512)
+	contentType := http.DetectContentType(head)
+	if t, _, _ := mime.ParseMediaType(contentType); !AttachmentTypes[t] {
+		http.Error(w, fmt.Sprintf("%v: %s", ErrAttachmentType, t), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	tmp, hash, size, err := db.storage.StoreBlob(body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "Attachment too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing attachment", "err", err)
+		return
+	}
+	defer os.Remove(tmp) // no-op after it's moved into place
+
+	err = db.Metadata.SetAttachment(&db.storage, user, note, name, tmp, Attachment{
+		Hash:        hash,
+		Size:        size,
+		ContentType: contentType,
+		Created:     time.Now(),
+	})
+	if errors.Is(err, ErrNotExist) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing attachment", "err", err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// expects following chi URL params: user, id, name
+func (db *Database) deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	name := chi.URLParam(r, "name")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can delete attachments", http.StatusForbidden)
+		return
+	}
+
+	if !db.Metadata.CheckPermission(user, note, session.Data.Username, PermissionWrite) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	if err := db.Metadata.RemoveAttachment(&db.storage, user, note, name); err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+}
+
+// exportNotes streams a zip archive with all of the user's notes.
+// Previous versions of the notes are included if the "history" query parameter is present.
+func (db *Database) exportNotes(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can export notes", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"senk-%s-%s.zip\"", session.Data.Username, time.Now().Format("2006-01-02")))
+	if err := db.Export(w, session.Data.Username, r.URL.Query().Has("history")); err != nil {
+		// The headers are already sent, so the client will receive a truncated archive.
+		slog.ErrorContext(r.Context(), "Error exporting notes", "err", err)
+	}
+}
+
+// importNotes creates notes from the zip archive of markdown files in the request body.
+// The optional "folder" query parameter specifies the folder to import the notes into.
+// The response is the JSON list of the imported files. If importing fails partway, the status
+// is 500 and the list has the files which were imported before the failure.
+func (db *Database) importNotes(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can import notes", http.StatusForbidden)
+		return
+	}
+
+	folder := r.URL.Query().Get("folder")
+	if folder != "" {
+		if _, err := db.Metadata.GetFolder(session.Data.Username, folder); err != nil {
+			http.Error(w, "Folder does not exist", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// zip.Reader needs random access, so the archive is saved to a temporary file first.
+	tmp, err := os.CreateTemp("", "senk-import-*.zip")
+	if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating temporary file for import", "err", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, MaxImportSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "Archive too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error serving import request, couldn't read request body", "err", err)
+		return
+	}
+
+	z, err := zip.NewReader(tmp, size)
+	if err != nil {
+		http.Error(w, "Invalid zip archive", http.StatusBadRequest)
+		return
+	}
+
+	imported, err := db.Import(r.Context(), z, session.Data.Username, folder)
+	status := http.StatusOK
+	if errors.Is(err, ErrImportTotalSize) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if errors.Is(err, ErrFolderDepth) || errors.Is(err, zip.ErrFormat) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Error importing notes", "err", err)
+		status = http.StatusInternalServerError
+	}
+	bytes, err := json.Marshal(imported)
+	if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling import result", "err", err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
 }
 
 // TODO: History
@@ -0,0 +1,191 @@
+// note attachments stored in a content-addressed blob store
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const MaxAttachmentSize = 20 << 20 // 20 MiB
+
+var (
+	ErrInvalidAttachmentName = errors.New("invalid attachment name")
+	ErrAttachmentType        = errors.New("attachment type not allowed")
+	ErrAttachmentNotExist    = errors.New("attachment does not exist")
+)
+
+// Attachment name must start with a letter or a number and contain only letters, numbers, dots, hyphens and underscores.
+var attachmentNameRules *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+// AttachmentTypes lists the allowed content types, as detected by http.DetectContentType.
+// Types which browsers could execute as scripts (html, svg) are deliberately not allowed.
+var AttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+	"application/zip": true,
+}
+
+type Attachment struct {
+	Hash        string // sha256 of the content, in hex
+	Size        int64
+	ContentType string
+	Created     time.Time
+}
+
+func CheckAttachmentName(name string) error {
+	if !attachmentNameRules.MatchString(name) {
+		return ErrInvalidAttachmentName
+	}
+	return nil
+}
+
+// blobPath returns the path of the blob with the given hash.
+func (s *Storage) blobPath(hash string) string {
+	return filepath.Join(s.Root, "_blobs", hash[:2], hash)
+}
+
+// StoreBlob streams the content into a temporary file in the blob store and returns its path, hash and size.
+// The file is moved into place by Metadata.SetAttachment, otherwise the caller has to remove it.
+func (s *Storage) StoreBlob(r io.Reader) (tmp, hash string, size int64, err error) {
+	dir := filepath.Join(s.Root, "_blobs")
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	tmp = f.Name()
+
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", "", 0, err
+	}
+	return tmp, hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+func (s *Storage) OpenBlob(hash string) (*os.File, error) {
+	return os.Open(s.blobPath(hash))
+}
+
+// RemoveBlob removes the blob. The caller must hold the metadata lock and check that the blob
+// isn't referenced, see Metadata.RemoveUnreferencedBlobs.
+func (s *Storage) RemoveBlob(hash string) error {
+	return os.Remove(s.blobPath(hash))
+}
+
+// removeBlobIfUnreferenced removes the blob unless a note has an attachment with it. The caller must hold the lock.
+func (m *Metadata) removeBlobIfUnreferenced(s *Storage, hash string) {
+	if m.blobReferenced(hash) {
+		return
+	}
+	if err := s.RemoveBlob(hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Error removing attachment blob", "hash", hash, "err", err)
+	}
+}
+
+// RemoveUnreferencedBlobs removes the blobs which no note has an attachment with.
+func (m *Metadata) RemoveUnreferencedBlobs(s *Storage, hashes []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, hash := range hashes {
+		m.removeBlobIfUnreferenced(s, hash)
+	}
+}
+
+// SetAttachment moves the blob stored by StoreBlob into place and adds the attachment to the note,
+// replacing the one with the same name, whose blob is removed if it's no longer referenced. Blobs are
+// only moved and removed with the lock held, so a blob can't be removed before it is referenced.
+func (m *Metadata) SetAttachment(s *Storage, user, id, name, tmp string, a Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta, ok := m.Notes[key]
+	if !ok {
+		return ErrNotExist
+	}
+	if err := os.MkdirAll(filepath.Dir(s.blobPath(a.Hash)), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.blobPath(a.Hash)); err != nil {
+		return err
+	}
+	if meta.Attachments == nil {
+		meta.Attachments = make(map[string]Attachment)
+	}
+	old, replaced := meta.Attachments[name]
+	meta.Attachments[name] = a
+	m.Notes[key] = meta
+	if replaced {
+		m.removeBlobIfUnreferenced(s, old.Hash)
+	}
+	return nil
+}
+
+// RemoveAttachment removes the attachment from the note, and its blob if it is no longer referenced.
+func (m *Metadata) RemoveAttachment(s *Storage, user, id, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta := m.Notes[key]
+	a, ok := meta.Attachments[name]
+	if !ok {
+		return ErrAttachmentNotExist
+	}
+	delete(meta.Attachments, name)
+	m.Notes[key] = meta
+	m.removeBlobIfUnreferenced(s, a.Hash)
+	return nil
+}
+
+func (m *Metadata) GetAttachment(user, id, name string) (Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.Notes[fmt.Sprintf("%s/%s", user, id)].Attachments[name]
+	if !ok {
+		return Attachment{}, ErrAttachmentNotExist
+	}
+	return a, nil
+}
+
+// blobReferenced returns true if any note has an attachment with the given hash.
+// The caller must hold the lock.
+func (m *Metadata) blobReferenced(hash string) bool {
+	for _, n := range m.Notes {
+		for _, a := range n.Attachments {
+			if a.Hash == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attachmentDisposition returns the Content-Disposition header for serving the attachment.
+// Only images are shown inline.
+func attachmentDisposition(name, contentType string) string {
+	if strings.HasPrefix(contentType, "image/") {
+		return fmt.Sprintf("inline; filename=\"%s\"", name)
+	}
+	return fmt.Sprintf("attachment; filename=\"%s\"", name)
+}
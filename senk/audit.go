@@ -0,0 +1,317 @@
+// append-only audit log
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditFileName is the name of the audit log in the data directory.
+const AuditFileName = "_audit"
+
+const (
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+// Audited actions
+const (
+	AuditSignIn            = "signin"
+	AuditSignInFailed      = "signin_failed"
+	AuditSignOut           = "signout"
+	AuditUserCreate        = "user_create"
+	AuditUserDelete        = "user_delete"
+	AuditUserPurge         = "user_purge"
+	AuditPasswordChange    = "password_change"
+	AuditRoleChange        = "role_change"
+	AuditUserDisable       = "user_disable"
+	AuditUserEnable        = "user_enable"
+	AuditSessionsRevoke    = "sessions_revoke"
+	AuditOIDCLink          = "oidc_link"
+	AuditNoteCreate        = "note_create"
+	AuditNoteWrite         = "note_write"
+	AuditNoteDelete        = "note_delete"
+	AuditNoteRestore       = "note_restore"
+	AuditNotePermissions   = "note_permissions"
+	AuditNoteMove          = "note_move"
+	AuditNoteTags          = "note_tags"
+	AuditTagRename         = "tag_rename"
+	AuditFolderPermissions = "folder_permissions"
+	AuditFolderDelete      = "folder_delete"
+)
+
+type AuditEntry struct {
+	Time   time.Time
+	Action string
+	Actor  string // user who did it, empty if not signed in
+	IP     string
+	Target string // "user/id" of a note or folder, or the username
+	Owner  string `json:",omitempty"` // owner of the note or folder, who can see the entry
+	Detail string `json:",omitempty"` // for example the sign in method
+}
+
+// AuditFilter selects entries. Empty fields match all entries.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Owner  string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // maximum number of the newest entries
+}
+
+func (f *AuditFilter) matches(e *AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		(f.Owner == "" || e.Owner == f.Owner) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// AuditLog appends entries as JSON lines to a file, which is never rewritten.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenAuditLog(dir string) (*AuditLog, error) {
+	path := filepath.Join(dir, AuditFileName)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: f}, nil
+}
+
+// Record appends the entry. Errors are logged, they don't stop the audited action.
+func (a *AuditLog) Record(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Error marshalling audit entry", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Error writing audit entry", "action", e.Action, "err", err)
+	}
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// size returns the current size of the log. Entries are only appended, so the log up to that size doesn't change.
+func (a *AuditLog) size() (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info, err := a.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// backup adds the log up to the size, as returned by size when the backup started, to the archive.
+func (a *AuditLog) backup(t *tarHashWriter, size int64) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return t.writeFile(AuditFileName, 0600, info.ModTime(), size, io.LimitReader(f, size))
+}
+
+// Query returns the newest entries matching the filter, the newest first.
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // partially written line
+		}
+		if filter.matches(&e) {
+			entries = append(entries, e)
+			if len(entries) > 2*filter.Limit {
+				entries = append(entries[:0], entries[len(entries)-filter.Limit:]...)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// clientIP returns the address of the client. The X-Forwarded-For header is only used if the request
+// comes from one of the proxies in forwarded_for.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && trustsProxy(GetConfig().ForwardedFor, r.RemoteAddr) {
+		addrs := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1]) // added by the trusted proxy
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// AuditMiddleware saves the client's address in the context, so that entries recorded
+// with only the context, for example in the storage worker, have it too.
+func AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ContextKey("clientIP"), clientIP(r))))
+	})
+}
+
+// audit records the entry. Unless the entry has them, the actor and the address are taken from the request's context.
+func (db *Database) audit(ctx context.Context, e AuditEntry) {
+	if _, session := GetSessionCtx(ctx); e.Actor == "" && session.Data.Authenticated {
+		e.Actor = session.Data.Username
+	}
+	if e.IP == "" {
+		e.IP, _ = ctx.Value(ContextKey("clientIP")).(string)
+	}
+	db.auditLog.Record(e)
+}
+
+// auditNoteWrite records a successful write to a note, done by the storage worker.
+func (db *Database) auditNoteWrite(w *NoteWrite) {
+	action := AuditNoteWrite
+	switch {
+	case w.create:
+		action = AuditNoteCreate
+	case w.delete:
+		action = AuditNoteDelete
+	case w.restore:
+		action = AuditNoteRestore
+	}
+	db.audit(w.ctx, AuditEntry{Action: action, Actor: w.user, Owner: w.owner, Target: w.owner + "/" + w.id})
+}
+
+// permissionsDetail describes the new permissions of a note or folder.
+func permissionsDetail(public PermissionLevel, shares map[string]PermissionLevel) string {
+	bytes, _ := json.Marshal(PermissionSettings{Public: public, Shares: shares})
+	return string(bytes)
+}
+
+// auditFilter reads the filter from the query parameters "actor", "action", "target", "owner",
+// "since" and "until" (RFC 3339 times) and "limit".
+func auditFilter(r *http.Request) (AuditFilter, error) {
+	q := r.URL.Query()
+	filter := AuditFilter{
+		Actor:  q.Get("actor"),
+		Action: q.Get("action"),
+		Target: strings.TrimPrefix(q.Get("target"), "~"),
+		Owner:  q.Get("owner"),
+		Limit:  auditDefaultLimit,
+	}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, errors.New("since must be an RFC 3339 time")
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, errors.New("until must be an RFC 3339 time")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > auditMaxLimit {
+			return filter, errors.New("limit must be between 1 and 1000")
+		}
+	}
+	return filter, nil
+}
+
+func (db *Database) serveAudit(w http.ResponseWriter, r *http.Request, filter AuditFilter) {
+	entries, err := db.auditLog.Query(filter)
+	if err != nil {
+		http.Error(w, "Couldn't read audit log", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error reading audit log", "err", err)
+		return
+	}
+	bytes, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, "Couldn't marshal audit log", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling audit log", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// getAudit serves the audit log to administrators.
+func (db *Database) getAudit(w http.ResponseWriter, r *http.Request) {
+	if !db.adminAuthorized(r) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.serveAudit(w, r, filter)
+}
+
+// getOwnAudit serves the entries about the signed in user's notes and folders.
+func (db *Database) getOwnAudit(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can read the audit log", http.StatusForbidden)
+		return
+	}
+	filter, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Owner = session.Data.Username
+	db.serveAudit(w, r, filter)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	config := DefaultConfig()
+	config.ForwardedFor = []string{"10.0.0.0/8"}
+	// trusting a proxy for authentication doesn't trust its X-Forwarded-For
+	config.ProxyAuth.TrustedProxies = []string{"192.0.2.0/24"}
+	SetConfig(config)
+	t.Cleanup(func() { SetConfig(nil) })
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"10.0.0.1:4000", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:4000", "203.0.113.1, 198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:4000", "", "10.0.0.1"},
+		{"192.0.2.1:4000", "198.51.100.7", "192.0.2.1"},
+		{"203.0.113.9:4000", "198.51.100.7", "203.0.113.9"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("clientIP from %s with %q = %q, want %q", test.remoteAddr, test.forwarded, got, test.want)
+		}
+	}
+}
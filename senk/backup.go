@@ -0,0 +1,418 @@
+// consistent backups of the whole data directory
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const BackupVersion = 1
+
+// BackupManifestName is the name of the last file in the backup archive.
+const BackupManifestName = "senk-backup.json"
+
+var ErrInvalidBackup = errors.New("invalid backup archive")
+
+// BackupManifest describes the contents of a backup archive.
+type BackupManifest struct {
+	Version int
+	Created time.Time
+	Files   map[string]string // sha256 of the content, in hex, indexed by the path in the archive
+}
+
+// tarHashWriter writes files to a tar archive and records their hashes.
+type tarHashWriter struct {
+	tw     *tar.Writer
+	hashes map[string]string
+}
+
+func (t *tarHashWriter) writeFile(name string, mode int64, modified time.Time, size int64, content io.Reader) error {
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     size,
+		ModTime:  modified,
+	})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(t.tw, h), content); err != nil {
+		return err
+	}
+	t.hashes[name] = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// writeDir adds all regular files in the directory (relative to root) to the archive.
+// Files for which skip returns true are left out.
+func (t *tarHashWriter) writeDir(root, dir string, skip func(name string) bool) error {
+	return filepath.WalkDir(filepath.Join(root, dir), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == filepath.Join(root, dir) {
+			return nil // nothing to back up
+		} else if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if skip != nil && skip(name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return t.writeFile(name, int64(info.Mode().Perm()), info.ModTime(), info.Size(), f)
+	})
+}
+
+// snapshotDir recreates the directory (relative to root) in the snapshot directory, with hard links to the
+// files, so that they can be archived later. Files for which skip returns true are left out, and the ones
+// for which copy returns true are copied instead, because they may be modified in place.
+func snapshotDir(root, snapshot, dir string, skip, copy func(name string) bool) error {
+	return filepath.WalkDir(filepath.Join(root, dir), func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == filepath.Join(root, dir) {
+			return nil // nothing to back up
+		} else if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if skip != nil && skip(name) {
+			return nil
+		}
+		dst := filepath.Join(snapshot, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if copy == nil || !copy(name) {
+			return linkOrCopy(p, dst)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := copyFile(p, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	})
+}
+
+// linkOrCopy hard links the file, or copies it if linking isn't possible.
+func linkOrCopy(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	return copyFile(src, dst, 0600)
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Backup writes a gzipped tar archive with the database, the audit log, the stores of all users, the attachments
+// and the archives of deleted users.
+// To get a consistent snapshot, the database is saved and the files are linked or copied into a temporary
+// directory by the storage worker, so that no notes are written meanwhile. The archive is written after
+// the worker is released, so a slow writer doesn't block reads and writes of notes.
+func (db *Database) Backup(w io.Writer) error {
+	manifest := BackupManifest{Version: BackupVersion, Created: time.Now()}
+	// in the data directory, so that the files can be linked, and skipped by restores like the other dot directories
+	tmp, err := os.MkdirTemp(db.storage.Root, ".backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var snapshot []byte
+	var auditSize int64
+	users := []string{}
+	err = db.RunStorageTask(func(s *Storage) error {
+		var err error
+		if snapshot, err = db.saveSnapshot(); err != nil {
+			return fmt.Errorf("failed to save the database: %w", err)
+		}
+		if auditSize, err = db.auditLog.size(); err != nil {
+			return fmt.Errorf("failed to back up the audit log: %w", err)
+		}
+		for user := range s.UserStores {
+			// Current versions of the notes are overwritten in place, previous ones never change.
+			err := snapshotDir(s.Root, tmp, user, nil, func(name string) bool {
+				return !strings.Contains(name, "/.history/")
+			})
+			if err != nil {
+				return fmt.Errorf("failed to back up the notes of \"%s\": %w", user, err)
+			}
+			users = append(users, user)
+		}
+		if err := snapshotDir(s.Root, tmp, DeletedDirName, nil, nil); err != nil {
+			return fmt.Errorf("failed to back up the archives of deleted users: %w", err)
+		}
+		// Uploads in progress are left out. Finished ones are complete, because blobs are only renamed into place.
+		return snapshotDir(s.Root, tmp, "_blobs", func(name string) bool {
+			return strings.HasPrefix(path.Base(name), "upload-")
+		}, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	t := tarHashWriter{tar.NewWriter(gz), make(map[string]string)}
+	if err := t.writeFile("_db", 0600, manifest.Created, int64(len(snapshot)), bytes.NewReader(snapshot)); err != nil {
+		return err
+	}
+	if err := db.auditLog.backup(&t, auditSize); err != nil {
+		return fmt.Errorf("failed to back up the audit log: %w", err)
+	}
+	for _, dir := range append(users, DeletedDirName, "_blobs") {
+		if err := t.writeDir(tmp, dir, nil); err != nil {
+			return err
+		}
+	}
+
+	manifest.Files = t.hashes
+	m, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := t.writeFile(BackupManifestName, 0600, manifest.Created, int64(len(m)), bytes.NewReader(m)); err != nil {
+		return err
+	}
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// checkBackupName returns an error if the path from the archive could point outside of the data directory.
+func checkBackupName(name string) error {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("%w: bad file name \"%s\"", ErrInvalidBackup, name)
+	}
+	return nil
+}
+
+// readBackup reads the archive, calling extract (if not nil) for every file but the manifest.
+// It verifies that all of the files match the manifest and that the database can be loaded.
+func readBackup(r io.Reader, extract func(h *tar.Header, content io.Reader) error) (BackupManifest, error) {
+	var manifest BackupManifest
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return manifest, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+	tr := tar.NewReader(gz)
+
+	hashes := make(map[string]string)
+	var database []byte
+	found := false
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if found {
+			return manifest, fmt.Errorf("%w: files after the manifest", ErrInvalidBackup)
+		}
+		if h.Typeflag != tar.TypeReg {
+			return manifest, fmt.Errorf("%w: \"%s\" is not a regular file", ErrInvalidBackup, h.Name)
+		}
+		if err := checkBackupName(h.Name); err != nil {
+			return manifest, err
+		}
+
+		if h.Name == BackupManifestName {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, fmt.Errorf("%w: can't read the manifest: %v", ErrInvalidBackup, err)
+			}
+			found = true
+			continue
+		}
+
+		hash := sha256.New()
+		content := io.TeeReader(tr, hash)
+		if h.Name == "_db" {
+			if database, err = io.ReadAll(content); err != nil {
+				return manifest, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+			}
+			content = bytes.NewReader(database)
+		}
+		if extract != nil {
+			err = extract(h, content)
+		} else {
+			_, err = io.Copy(io.Discard, content)
+		}
+		if err != nil {
+			return manifest, err
+		}
+		hashes[h.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if !found {
+		return manifest, fmt.Errorf("%w: missing manifest", ErrInvalidBackup)
+	}
+	if manifest.Version != BackupVersion {
+		return manifest, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, manifest.Version)
+	}
+	if len(hashes) != len(manifest.Files) {
+		return manifest, fmt.Errorf("%w: the manifest lists %d files, the archive contains %d", ErrInvalidBackup, len(manifest.Files), len(hashes))
+	}
+	for name, hash := range manifest.Files {
+		if hashes[name] != hash {
+			return manifest, fmt.Errorf("%w: checksum mismatch for \"%s\"", ErrInvalidBackup, name)
+		}
+	}
+	if database == nil {
+		return manifest, fmt.Errorf("%w: missing database", ErrInvalidBackup)
+	}
+	if err := json.Unmarshal(database, &Database{}); err != nil {
+		return manifest, fmt.Errorf("%w: can't read the database: %v", ErrInvalidBackup, err)
+	}
+	return manifest, nil
+}
+
+// VerifyBackup checks the archive without extracting it.
+func VerifyBackup(r io.Reader) (BackupManifest, error) {
+	return readBackup(r, nil)
+}
+
+// RestoreBackup replaces the contents of the data directory with the backup. The archive is
+// verified first and extracted into a temporary directory, so the data is only replaced if it's valid.
+// The previous contents are moved into a ".pre-restore-<time>" directory, whose path is returned.
+func RestoreBackup(f io.ReadSeeker, dir string) (string, error) {
+	if _, err := VerifyBackup(f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.MkdirTemp(dir, ".restore-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp) // empty after a successful restore
+	_, err = readBackup(f, func(h *tar.Header, content io.Reader) error {
+		p := filepath.Join(tmp, filepath.FromSlash(h.Name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_EXCL, fs.FileMode(h.Mode).Perm()|0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, content); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(p, h.ModTime, h.ModTime)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	old := filepath.Join(dir, ".pre-restore-"+time.Now().Format("20060102-150405"))
+	if err := os.Mkdir(old, 0700); err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue // previous restores and the temporary directory
+		}
+		if err := os.Rename(filepath.Join(dir, e.Name()), filepath.Join(old, e.Name())); err != nil {
+			return old, fmt.Errorf("failed to move away \"%s\": %w", e.Name(), err)
+		}
+	}
+	entries, err = os.ReadDir(tmp)
+	if err != nil {
+		return old, err
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(tmp, e.Name()), filepath.Join(dir, e.Name())); err != nil {
+			return old, fmt.Errorf("failed to move \"%s\" into place: %w", e.Name(), err)
+		}
+	}
+	return old, nil
+}
+
+// hasBearerToken returns true if the request's Authorization header has the token, which must not be empty.
+func hasBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1
+}
+
+// backup streams a backup archive of the whole data directory.
+func (db *Database) backup(w http.ResponseWriter, r *http.Request) {
+	if !db.adminAuthorized(r) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"senk-backup-%s.tar.gz\"", time.Now().Format("20060102-150405")))
+	if err := db.Backup(w); err != nil {
+		// The archive is incomplete, which the client will notice when verifying it.
+		slog.ErrorContext(r.Context(), "Error creating backup", "err", err)
+	}
+}
@@ -2,19 +2,25 @@ package main
 
 import (
 	"embed"
-	"log"
+	"html/template"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 //go:embed html/*
 var html embed.FS
 
+var templates = template.Must(template.ParseFS(html, "html/*.html"))
+
 func serveStatic(file, contentType string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		f, err := html.ReadFile("html/" + file)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
-			log.Printf("Error: serveStatic couldn't find file \"%s\" (it wasn't bundled during compilation).", file)
+			slog.Error("serveStatic couldn't find the file, it wasn't bundled during compilation", "file", file)
 		} else {
 			w.Header().Add("Content-Type", contentType)
 			w.Write(f)
@@ -22,21 +28,52 @@ func serveStatic(file, contentType string) http.HandlerFunc {
 	}
 }
 
-func serveLogin(w http.ResponseWriter, r *http.Request) {
-	serveStatic("signin.html", "text/html")(w, r)
+// signInPage is the data of the sign in page.
+type signInPage struct {
+	Password bool   // signing in with a password is enabled
+	OIDC     bool   // signing in with an identity provider is enabled
+	Redirect string // path of the requested page, to return to after signing in with the identity provider
 }
 
-func serveApp(w http.ResponseWriter, r *http.Request) {
-	serveStatic("app.html", "text/html")(w, r)
+func serveLogin(w http.ResponseWriter, r *http.Request) {
+	config := GetConfig()
+	p := signInPage{
+		Password: !config.OIDC.DisablePassword,
+		OIDC:     config.OIDC.Enabled(),
+		Redirect: r.URL.Path,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, "signin.html", p); err != nil {
+		slog.Error("Error executing sign in template", "err", err)
+	}
 }
 
-func (db *Database) serveMain(w http.ResponseWriter, r *http.Request) {
-	sid, _ := GetSessionCtx(r.Context())
-	if sid == "" {
-		serveLogin(w, r)
-	} else {
-		serveApp(w, r)
+// preferredType returns the media type from the offers which the client prefers according
+// to the Accept header, or the first offer if the header is missing.
+func preferredType(r *http.Request, offers ...string) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
 	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		for _, part := range strings.Split(accept, ",") {
+			mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+			typ, _, _ := strings.Cut(offer, "/")
+			if (mt == offer || mt == typ+"/*" || mt == "*/*") && q > bestQ {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	if best == "" {
+		return offers[0]
+	}
+	return best
 }
-
-// TODO: Bundle data in HTML responses, to avoid additional request and make the app even barely usable without JS.
@@ -0,0 +1,434 @@
+// command line interface
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const usage = `Usage: senk [flags] [command] [command flags]
+
+Without a command, senk starts the server. Commands which modify data
+refuse to run while the server is running. Commands:
+  config    validate the configuration and print it
+  export    write a zip archive with all notes of a user
+  import    create notes from a directory or a zip archive of markdown files
+  backup    write a backup archive of the running server's data directory
+  restore   verify a backup archive and replace the data directory with it
+  admin     give a user the admin role, optionally creating them first
+`
+
+// runCommand executes the command given in the arguments and returns the exit code.
+func runCommand(dir string, args []string) int {
+	switch args[0] {
+	case "config":
+		return configCommand()
+	case "export":
+		return exportCommand(dir, args[1:])
+	case "import":
+		return importCommand(dir, args[1:])
+	case "backup":
+		return backupCommand(dir, args[1:])
+	case "restore":
+		return restoreCommand(dir, args[1:])
+	case "admin":
+		return adminCommand(dir, args[1:])
+	case "help":
+		flag.CommandLine.SetOutput(os.Stdout)
+		flag.Usage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command \"%s\".\n\n", args[0])
+		flag.Usage()
+		return 2
+	}
+}
+
+// configCommand prints the effective configuration, without the secrets.
+func configCommand() int {
+	config := *GetConfig()
+	if config.AdminToken != "" {
+		config.AdminToken = "<redacted>"
+	}
+	if config.Backup.Passphrase != "" {
+		config.Backup.Passphrase = "<redacted>"
+	}
+	if config.OIDC.ClientSecret != "" {
+		config.OIDC.ClientSecret = "<redacted>"
+	}
+	if err := toml.NewEncoder(os.Stdout).Encode(config); err != nil {
+		log.Printf("Failed to print the configuration: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// loadDatabase loads the database for a command, logging the error.
+func loadDatabase(dir string) (*Database, bool) {
+	db, err := LoadDatabase(dir)
+	if err != nil {
+		log.Printf("Failed to load database: %v", err)
+		return nil, false
+	}
+	return db, true
+}
+
+func exportCommand(dir string, args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	user := flags.String("user", "", "user whose notes to export (required)")
+	history := flags.Bool("history", false, "include previous versions of the notes")
+	output := flags.String("o", "", "output file (default: standard output)")
+	flags.Parse(args)
+
+	if *user == "" {
+		flags.Usage()
+		return 2
+	}
+	db, ok := loadDatabase(dir)
+	if !ok {
+		return 1
+	}
+	if _, err := db.Users.GetUser(*user); err != nil {
+		log.Printf("Can't export notes of \"%s\": %v", *user, err)
+		return 1
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Printf("Failed to create the output file: %v", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	db.StartStorageWorker()
+	if err := db.Export(out, *user, *history); err != nil {
+		log.Printf("Failed to export notes: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func importCommand(dir string, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	user := flags.String("user", "", "user who will own the notes (required)")
+	folder := flags.String("folder", "", "id of the folder to import the notes into")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: senk import -user name [-folder id] <directory or zip archive>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *user == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	unlock, ok := lockDataDir(dir)
+	if !ok {
+		return 1
+	}
+	defer unlock()
+	db, ok := loadDatabase(dir)
+	if !ok {
+		return 1
+	}
+	if _, err := db.Users.GetUser(*user); err != nil {
+		log.Printf("Can't import notes for \"%s\": %v", *user, err)
+		return 1
+	}
+	if *folder != "" {
+		if _, err := db.Metadata.GetFolder(*user, *folder); err != nil {
+			log.Printf("Can't import notes into folder \"%s\": %v", *folder, err)
+			return 1
+		}
+	}
+
+	var fsys fs.FS
+	src := flags.Arg(0)
+	if info, err := os.Stat(src); err != nil {
+		log.Printf("Can't import notes: %v", err)
+		return 1
+	} else if info.IsDir() {
+		fsys = os.DirFS(src)
+	} else {
+		z, err := zip.OpenReader(src)
+		if err != nil {
+			log.Printf("Can't open the archive: %v", err)
+			return 1
+		}
+		defer z.Close()
+		fsys = z
+	}
+
+	db.StartStorageWorker()
+	imported, err := db.Import(context.Background(), fsys, *user, *folder)
+	for _, n := range imported {
+		if n.Err != "" {
+			log.Printf("Failed to import %s: %s", n.File, n.Err)
+		} else {
+			fmt.Printf("%s\t~%s\n", n.File, n.Path)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to import notes: %v", err)
+	}
+	if err := db.Save(); err != nil || len(imported) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// backupCommand requests a backup from the running server, so that it's consistent. With -offline,
+// the backup is created directly from the data directory, which requires the server to be stopped.
+func backupCommand(dir string, args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:3000", "address of the running server")
+	offline := flags.Bool("offline", false, "back up the data directory directly, the server must not be running")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: senk backup [-server url | -offline] <file or directory>\n"+
+			"The admin token is read from the configuration.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if !*offline && GetConfig().AdminToken == "" {
+		log.Printf("Backing up the running server requires the admin token, set admin_token or SENK_ADMIN_TOKEN, or use -offline")
+		return 1
+	}
+	dest := flags.Arg(0)
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, fmt.Sprintf("senk-backup-%s.tar.gz", time.Now().Format("20060102-150405")))
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_RDWR|os.O_EXCL, 0600)
+	if err != nil {
+		log.Printf("Failed to create the backup file: %v", err)
+		return 1
+	}
+	defer f.Close()
+	failed := func() int {
+		f.Close()
+		os.Remove(dest)
+		return 1
+	}
+
+	if *offline {
+		unlock, ok := lockDataDir(dir)
+		if !ok {
+			return failed()
+		}
+		defer unlock()
+		db, ok := loadDatabase(dir)
+		if !ok {
+			return failed()
+		}
+		db.StartStorageWorker()
+		if err := db.Backup(f); err != nil {
+			log.Printf("Failed to create the backup: %v", err)
+			return failed()
+		}
+	} else {
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*server, "/")+"/admin/backup", nil)
+		if err != nil {
+			log.Printf("Invalid server address: %v", err)
+			return failed()
+		}
+		req.Header.Set("Authorization", "Bearer "+GetConfig().AdminToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Failed to request the backup: %v", err)
+			return failed()
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("Failed to request the backup: %s", resp.Status)
+			return failed()
+		}
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			log.Printf("Failed to download the backup: %v", err)
+			return failed()
+		}
+	}
+
+	// Errors are only noticed once the archive is read back.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		log.Printf("Failed to verify the backup: %v", err)
+		return failed()
+	}
+	manifest, err := VerifyBackup(f)
+	if err != nil {
+		log.Printf("Failed to verify the backup: %v", err)
+		return failed()
+	}
+	fmt.Printf("%s\t%d files\n", dest, len(manifest.Files))
+	return 0
+}
+
+// openBackupArchive opens the archive for reading. Encrypted archives (with the ".age" extension)
+// are decrypted into a temporary file in the directory, which is removed when the returned function is called.
+func openBackupArchive(name, identityFile, dir string) (io.ReadSeeker, func(), error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(name, ".age") {
+		return f, func() { f.Close() }, nil
+	}
+	defer f.Close()
+
+	r, err := decryptBackup(f, identityFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt the archive: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".decrypted-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	remove := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		remove()
+		return nil, nil, fmt.Errorf("failed to decrypt the archive: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return tmp, remove, nil
+}
+
+func restoreCommand(dir string, args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	verify := flags.Bool("verify", false, "only verify the archive")
+	identity := flags.String("identity", "", "age identity file for decrypting the archive (default: the configured backup passphrase)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: senk restore [-verify] [-identity file] <backup archive>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	f, closeArchive, err := openBackupArchive(flags.Arg(0), *identity, dir)
+	if err != nil {
+		log.Printf("Can't open the archive: %v", err)
+		return 1
+	}
+	defer closeArchive()
+
+	if *verify {
+		manifest, err := VerifyBackup(f)
+		if err != nil {
+			log.Printf("Verification failed: %v", err)
+			return 1
+		}
+		fmt.Printf("Backup from %s with %d files is valid.\n", manifest.Created.Format(time.RFC3339), len(manifest.Files))
+		return 0
+	}
+
+	unlock, ok := lockDataDir(dir)
+	if !ok {
+		return 1
+	}
+	defer unlock()
+
+	old, err := RestoreBackup(f, dir)
+	if err != nil {
+		log.Printf("Failed to restore the backup: %v", err)
+		if old != "" {
+			log.Printf("The previous data has been moved to %s.", old)
+		}
+		return 1
+	}
+	fmt.Printf("Backup restored. The previous data has been moved to %s.\n", old)
+	return 0
+}
+
+// adminCommand gives the user the admin role, or takes it away with -revoke. It's how the first
+// administrator is set up. With -create, the user is created first, with the password from the standard input.
+// While the server is running, users are managed on the admin page, which accepts the admin token.
+func adminCommand(dir string, args []string) int {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	revoke := flags.Bool("revoke", false, "take the admin role away instead")
+	create := flags.Bool("create", false, "create the user, reading the password from the standard input")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: senk admin [-create | -revoke] <username>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *create && *revoke {
+		flags.Usage()
+		return 2
+	}
+	username := flags.Arg(0)
+	unlock, ok := lockDataDir(dir)
+	if !ok {
+		return 1
+	}
+	defer unlock()
+	db, ok := loadDatabase(dir)
+	if !ok {
+		return 1
+	}
+
+	if *create {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("Failed to read the password: %v", err)
+			return 1
+		}
+		db.StartStorageWorker()
+		if err := db.AddUser(username, strings.TrimRight(password, "\r\n")); err != nil {
+			log.Printf("Failed to create \"%s\": %v", username, err)
+			return 1
+		}
+		db.auditLog.Record(AuditEntry{Action: AuditUserCreate, Target: username, Detail: "cli"})
+	}
+
+	role := RoleAdmin
+	if *revoke {
+		role = RoleUser
+	}
+	if err := db.Users.SetRole(username, role); err != nil {
+		log.Printf("Failed to change the role of \"%s\": %v", username, err)
+		return 1
+	}
+	db.auditLog.Record(AuditEntry{Action: AuditRoleChange, Target: username, Detail: role})
+	if err := db.Save(); err != nil {
+		return 1
+	}
+	if *revoke {
+		fmt.Printf("~%s is no longer an administrator.\n", username)
+	} else {
+		fmt.Printf("~%s is now an administrator.\n", username)
+	}
+	return 0
+}
@@ -0,0 +1,498 @@
+// configuration from a file, environment variables and command line flags
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alexedwards/argon2id"
+)
+
+// Duration is a time.Duration which is written as a string in the config file, for example "90m" or "24h".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+type SessionConfig struct {
+	IdleTimeout     Duration `toml:"idle_timeout"`     // sessions not used for this long expire
+	AbsoluteTimeout Duration `toml:"absolute_timeout"` // users have to sign in again after this long
+}
+
+type PasswordConfig struct {
+	MinLength   int `toml:"min_length"`
+	MaxLength   int `toml:"max_length"`
+	MinStrength int `toml:"min_strength"` // zxcvbn score, from 0 to 4
+}
+
+// Argon2Config holds the argon2id parameters for new password hashes.
+type Argon2Config struct {
+	Memory      uint32 `toml:"memory"` // in KiB
+	Iterations  uint32 `toml:"iterations"`
+	Parallelism uint8  `toml:"parallelism"`
+	SaltLength  uint32 `toml:"salt_length"`
+	KeyLength   uint32 `toml:"key_length"`
+}
+
+func (a Argon2Config) Params() *argon2id.Params {
+	return &argon2id.Params{
+		Memory:      a.Memory,
+		Iterations:  a.Iterations,
+		Parallelism: a.Parallelism,
+		SaltLength:  a.SaltLength,
+		KeyLength:   a.KeyLength,
+	}
+}
+
+type BackupConfig struct {
+	Dir         string   `toml:"dir"` // scheduled backups are disabled if empty
+	Interval    Duration `toml:"interval"`
+	Recipient   string   `toml:"recipient"`  // age public key
+	Passphrase  string   `toml:"passphrase"` // used instead of the recipient
+	KeepDaily   int      `toml:"keep_daily"`
+	KeepWeekly  int      `toml:"keep_weekly"`
+	KeepMonthly int      `toml:"keep_monthly"`
+}
+
+type TLSConfig struct {
+	Cert         string `toml:"cert"` // certificate and key files, reloaded when they change
+	Key          string `toml:"key"`
+	SelfSigned   bool   `toml:"self_signed"`   // for development, generate a certificate for localhost instead
+	RedirectAddr string `toml:"redirect_addr"` // if set, plain HTTP requests on this address are redirected to HTTPS
+
+	// InsecureCookies allows signing in over plain HTTP on localhost, for development without TLS.
+	InsecureCookies bool `toml:"insecure_cookies"`
+}
+
+// Enabled returns true if the server should serve HTTPS.
+func (t TLSConfig) Enabled() bool {
+	return t.Cert != "" || t.SelfSigned
+}
+
+// OIDCConfig enables signing in with an OpenID Connect identity provider.
+type OIDCConfig struct {
+	Issuer       string `toml:"issuer"` // discovery is done at {issuer}/.well-known/openid-configuration
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"` // empty for public clients
+	RedirectURL  string `toml:"redirect_url"`  // must end with /session/oidc/callback
+	Scopes       string `toml:"scopes"`        // separated by spaces, must include "openid"
+	// UsernameClaim is the ID token claim with the username, only used for naming new users. Users sign in
+	// with the identity they're linked to, existing users are linked by an administrator.
+	UsernameClaim string `toml:"username_claim"`
+	CreateUsers   bool   `toml:"create_users"` // create and link users which don't exist yet, when they sign in
+	// DisablePassword disables signing in with a password, so that the identity provider is the only way.
+	DisablePassword bool `toml:"disable_password"`
+}
+
+// Enabled returns true if signing in with the identity provider is configured.
+func (o OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// ProxyAuthConfig enables authentication by a reverse proxy, which sets the header to the username.
+type ProxyAuthConfig struct {
+	Header string `toml:"header"` // for example "X-Forwarded-User", disabled if empty
+	// TrustedProxies are the CIDRs of the proxies whose header is trusted. Requests over a unix socket
+	// are only trusted if it includes "unix", then the socket's permissions control who can connect.
+	TrustedProxies []string `toml:"trusted_proxies"`
+	CreateUsers    bool     `toml:"create_users"` // create users which don't exist yet
+}
+
+// trustedUnix in the trusted proxies makes requests over a unix socket trusted.
+const trustedUnix = "unix"
+
+// Trusts returns true if the header of a request from the remote address can be trusted.
+func (p ProxyAuthConfig) Trusts(remoteAddr string) bool {
+	return trustsProxy(p.TrustedProxies, remoteAddr)
+}
+
+// trustsProxy returns true if the remote address is in one of the CIDRs, or if it's a unix socket and they include "unix".
+func trustsProxy(proxies []string, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		unix := remoteAddr == "" || remoteAddr == "@"
+		return unix && slices.Contains(proxies, trustedUnix)
+	}
+	for _, cidr := range proxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricsConfig enables the Prometheus metrics endpoint. It's served on the separate address if it's set,
+// otherwise on the main one at /metrics, which then requires the token.
+type MetricsConfig struct {
+	Addr  string `toml:"addr"`
+	Token string `toml:"token"` // bearer token, required on the main address and optional on the separate one
+}
+
+type LogConfig struct {
+	Format string `toml:"format"` // "text" or "json"
+	Level  string `toml:"level"`  // reloadable, "debug", "info", "warn" or "error"
+}
+
+// Config holds all of the settings. The ones marked as reloadable are applied on SIGHUP,
+// changes to the rest require a restart.
+type Config struct {
+	Dir          string   `toml:"dir"`
+	Addr         string   `toml:"addr"`          // tcp address or "unix:" followed by a socket path
+	SocketMode   string   `toml:"socket_mode"`   // permissions of the unix socket, in octal
+	SocketGroup  string   `toml:"socket_group"`  // group of the unix socket, if set
+	SaveInterval Duration `toml:"save_interval"` // reloadable
+	AdminToken   string   `toml:"admin_token"`   // reloadable, admin endpoints also accept signed in administrators
+
+	// DeletionGracePeriod is how long the data of deleted users is archived before it's purged. Reloadable.
+	DeletionGracePeriod Duration `toml:"deletion_grace_period"`
+	// RemoteImages allows images in notes to be loaded from other sites over HTTPS, which then learn
+	// who reads the notes and when. Reloadable.
+	RemoteImages bool `toml:"remote_images"`
+	// ForwardedFor are the CIDRs of the reverse proxies whose X-Forwarded-For header gives the client's
+	// address in the audit log, and "unix" for a proxy on the unix socket. Reloadable.
+	ForwardedFor []string `toml:"forwarded_for"`
+
+	Session  SessionConfig  `toml:"session"`  // reloadable
+	Password PasswordConfig `toml:"password"` // reloadable
+	Argon2   Argon2Config   `toml:"argon2"`   // reloadable
+	Backup   BackupConfig   `toml:"backup"`
+	TLS      TLSConfig      `toml:"tls"`
+	Metrics  MetricsConfig  `toml:"metrics"`
+	Log      LogConfig      `toml:"log"`
+	OIDC     OIDCConfig     `toml:"oidc"`
+
+	ProxyAuth ProxyAuthConfig `toml:"proxy_auth"` // reloadable
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Addr:                ":3000",
+		SocketMode:          "0660",
+		SaveInterval:        Duration{time.Minute},
+		DeletionGracePeriod: Duration{time.Hour * 24 * 30},
+		Session: SessionConfig{
+			IdleTimeout:     Duration{time.Hour * 24 * 90},  // remember session for 90 days
+			AbsoluteTimeout: Duration{time.Hour * 24 * 365}, // require the user to reauthenticate every 365 days
+		},
+		Password: PasswordConfig{MinLength: 8, MaxLength: 256, MinStrength: 2},
+		Log:      LogConfig{Format: "text", Level: "info"},
+		Argon2:   Argon2Config(*argon2id.DefaultParams),
+		Backup: BackupConfig{
+			Interval:    Duration{24 * time.Hour},
+			KeepDaily:   7,
+			KeepWeekly:  4,
+			KeepMonthly: 12,
+		},
+		OIDC: OIDCConfig{Scopes: "openid profile email", UsernameClaim: "preferred_username"},
+	}
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// GetConfig returns the current configuration, which must not be modified.
+func GetConfig() *Config {
+	if c := currentConfig.Load(); c != nil {
+		return c
+	}
+	return DefaultConfig()
+}
+
+func SetConfig(c *Config) {
+	currentConfig.Store(c)
+}
+
+// Reload replaces the reloadable settings of the current configuration with the ones from next.
+// It returns the names of the changed settings which require a restart.
+func (c *Config) Reload(next *Config) (ignored []string) {
+	reloaded := *c
+	reloaded.SaveInterval = next.SaveInterval
+	reloaded.AdminToken = next.AdminToken
+	reloaded.DeletionGracePeriod = next.DeletionGracePeriod
+	reloaded.RemoteImages = next.RemoteImages
+	reloaded.ForwardedFor = next.ForwardedFor
+	reloaded.Session = next.Session
+	reloaded.Password = next.Password
+	reloaded.Argon2 = next.Argon2
+	reloaded.Log.Level = next.Log.Level
+	reloaded.ProxyAuth = next.ProxyAuth
+	if next.Dir != c.Dir {
+		ignored = append(ignored, "dir")
+	}
+	if next.Addr != c.Addr || next.SocketMode != c.SocketMode || next.SocketGroup != c.SocketGroup {
+		ignored = append(ignored, "addr")
+	}
+	if next.Backup != c.Backup {
+		ignored = append(ignored, "backup")
+	}
+	if next.TLS != c.TLS {
+		ignored = append(ignored, "tls")
+	}
+	if next.Metrics != c.Metrics {
+		ignored = append(ignored, "metrics")
+	}
+	if next.Log.Format != c.Log.Format {
+		ignored = append(ignored, "log.format")
+	}
+	if next.OIDC != c.OIDC {
+		ignored = append(ignored, "oidc")
+	}
+	SetConfig(&reloaded)
+	return
+}
+
+// applyEnv overrides the settings with the environment variables which are set.
+func (c *Config) applyEnv() error {
+	texts := map[string]*string{
+		"SENK_DIR":                &c.Dir,
+		"SENK_ADDR":               &c.Addr,
+		"SENK_SOCKET_MODE":        &c.SocketMode,
+		"SENK_SOCKET_GROUP":       &c.SocketGroup,
+		"SENK_ADMIN_TOKEN":        &c.AdminToken,
+		"SENK_BACKUP_DIR":         &c.Backup.Dir,
+		"SENK_BACKUP_RECIPIENT":   &c.Backup.Recipient,
+		"SENK_BACKUP_PASSPHRASE":  &c.Backup.Passphrase,
+		"SENK_TLS_CERT":           &c.TLS.Cert,
+		"SENK_TLS_KEY":            &c.TLS.Key,
+		"SENK_TLS_REDIRECT_ADDR":  &c.TLS.RedirectAddr,
+		"SENK_METRICS_ADDR":       &c.Metrics.Addr,
+		"SENK_METRICS_TOKEN":      &c.Metrics.Token,
+		"SENK_LOG_FORMAT":         &c.Log.Format,
+		"SENK_LOG_LEVEL":          &c.Log.Level,
+		"SENK_OIDC_ISSUER":        &c.OIDC.Issuer,
+		"SENK_OIDC_CLIENT_ID":     &c.OIDC.ClientID,
+		"SENK_OIDC_CLIENT_SECRET": &c.OIDC.ClientSecret,
+		"SENK_OIDC_REDIRECT_URL":  &c.OIDC.RedirectURL,
+		"SENK_PROXY_AUTH_HEADER":  &c.ProxyAuth.Header,
+	}
+	for name, s := range texts {
+		if v := os.Getenv(name); v != "" {
+			*s = v
+		}
+	}
+
+	lists := map[string]*[]string{
+		"SENK_FORWARDED_FOR":              &c.ForwardedFor,
+		"SENK_PROXY_AUTH_TRUSTED_PROXIES": &c.ProxyAuth.TrustedProxies,
+	}
+	for name, l := range lists {
+		if v := os.Getenv(name); v != "" {
+			*l = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+		}
+	}
+
+	durations := map[string]*Duration{
+		"SENK_SAVE_INTERVAL":            &c.SaveInterval,
+		"SENK_SESSION_IDLE_TIMEOUT":     &c.Session.IdleTimeout,
+		"SENK_SESSION_ABSOLUTE_TIMEOUT": &c.Session.AbsoluteTimeout,
+		"SENK_BACKUP_INTERVAL":          &c.Backup.Interval,
+		"SENK_DELETION_GRACE_PERIOD":    &c.DeletionGracePeriod,
+	}
+	for name, d := range durations {
+		if v := os.Getenv(name); v != "" {
+			if err := d.UnmarshalText([]byte(v)); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	bools := map[string]*bool{
+		"SENK_REMOTE_IMAGES":           &c.RemoteImages,
+		"SENK_TLS_SELF_SIGNED":         &c.TLS.SelfSigned,
+		"SENK_TLS_INSECURE_COOKIES":    &c.TLS.InsecureCookies,
+		"SENK_OIDC_CREATE_USERS":       &c.OIDC.CreateUsers,
+		"SENK_PROXY_AUTH_CREATE_USERS": &c.ProxyAuth.CreateUsers,
+	}
+	for name, b := range bools {
+		if v := os.Getenv(name); v != "" {
+			var err error
+			if *b, err = strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	ints := map[string]*int{
+		"SENK_PASSWORD_MIN_LENGTH":   &c.Password.MinLength,
+		"SENK_PASSWORD_MAX_LENGTH":   &c.Password.MaxLength,
+		"SENK_PASSWORD_MIN_STRENGTH": &c.Password.MinStrength,
+		"SENK_BACKUP_KEEP_DAILY":     &c.Backup.KeepDaily,
+		"SENK_BACKUP_KEEP_WEEKLY":    &c.Backup.KeepWeekly,
+		"SENK_BACKUP_KEEP_MONTHLY":   &c.Backup.KeepMonthly,
+	}
+	for name, n := range ints {
+		if v := os.Getenv(name); v != "" {
+			var err error
+			if *n, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applyFlags overrides the settings with the flags which were given on the command line.
+func (c *Config) applyFlags(flags *flag.FlagSet) error {
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dir":
+			c.Dir = f.Value.String()
+		case "addr":
+			c.Addr = f.Value.String()
+		case "save-interval":
+			if e := c.SaveInterval.UnmarshalText([]byte(f.Value.String())); e != nil {
+				err = fmt.Errorf("invalid -save-interval: %w", e)
+			}
+		}
+	})
+	return err
+}
+
+// Validate returns an error describing the first invalid setting.
+func (c *Config) Validate() error {
+	switch {
+	case c.Dir == "":
+		return errors.New("dir must point to the data directory")
+	case c.Addr == "":
+		return errors.New("addr must not be empty")
+	case checkSocketMode(c.SocketMode) != nil:
+		return checkSocketMode(c.SocketMode)
+	case checkLogFormat(c.Log.Format) != nil:
+		return checkLogFormat(c.Log.Format)
+	case c.SaveInterval.Duration < time.Second:
+		return errors.New("save_interval must be at least one second")
+	case c.DeletionGracePeriod.Duration < 0:
+		return errors.New("deletion_grace_period must not be negative")
+	case c.Session.IdleTimeout.Duration <= 0 || c.Session.AbsoluteTimeout.Duration <= 0:
+		return errors.New("session timeouts must be positive")
+	case c.Session.IdleTimeout.Duration > c.Session.AbsoluteTimeout.Duration:
+		return errors.New("session.idle_timeout must not be longer than session.absolute_timeout")
+	case c.Password.MinLength < 1 || c.Password.MaxLength < c.Password.MinLength || c.Password.MaxLength > 4096:
+		return errors.New("password lengths must satisfy 1 <= min_length <= max_length <= 4096")
+	case c.Password.MinStrength < 0 || c.Password.MinStrength > 4:
+		return errors.New("password.min_strength must be between 0 and 4")
+	case c.Argon2.Iterations < 1 || c.Argon2.Parallelism < 1 || c.Argon2.Memory < 8*uint32(c.Argon2.Parallelism):
+		return errors.New("argon2 needs at least one iteration and thread, and 8 KiB of memory per thread")
+	case c.Argon2.SaltLength < 8 || c.Argon2.KeyLength < 16:
+		return errors.New("argon2.salt_length must be at least 8 and argon2.key_length at least 16")
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		return errors.New("log.level must be \"debug\", \"info\", \"warn\" or \"error\"")
+	}
+
+	switch t := c.TLS; {
+	case (t.Cert == "") != (t.Key == ""):
+		return errors.New("tls.cert and tls.key must be set together")
+	case t.Cert != "" && t.SelfSigned:
+		return errors.New("tls.self_signed can't be used with tls.cert")
+	case t.RedirectAddr != "" && !t.Enabled():
+		return errors.New("tls.redirect_addr requires tls.cert or tls.self_signed")
+	}
+
+	if b := c.Backup; b.Dir != "" {
+		switch {
+		case b.Interval.Duration < time.Minute:
+			return errors.New("backup.interval must be at least one minute")
+		case b.KeepDaily < 0 || b.KeepWeekly < 0 || b.KeepMonthly < 0:
+			return errors.New("backup retention counts must not be negative")
+		case b.Recipient != "" && b.Passphrase != "":
+			return errors.New("only one of backup.recipient and backup.passphrase can be set")
+		case b.Recipient == "" && b.Passphrase == "":
+			return errors.New("scheduled backups must be encrypted, set backup.recipient or backup.passphrase")
+		}
+	}
+
+	if o := c.OIDC; o.Enabled() {
+		switch {
+		case o.ClientID == "" || o.RedirectURL == "":
+			return errors.New("oidc.client_id and oidc.redirect_url must be set")
+		case !strings.HasSuffix(o.RedirectURL, "/session/oidc/callback"):
+			return errors.New("oidc.redirect_url must end with /session/oidc/callback")
+		case !slices.Contains(strings.Fields(o.Scopes), "openid"):
+			return errors.New("oidc.scopes must include \"openid\"")
+		case o.UsernameClaim == "":
+			return errors.New("oidc.username_claim must not be empty")
+		}
+	} else if c.OIDC.DisablePassword {
+		return errors.New("oidc.disable_password requires oidc.issuer")
+	}
+
+	if err := checkProxies(c.ForwardedFor); err != nil {
+		return fmt.Errorf("forwarded_for: %w", err)
+	}
+	if p := c.ProxyAuth; p.Header != "" {
+		if len(p.TrustedProxies) == 0 {
+			return errors.New("proxy_auth.trusted_proxies must list the proxies' CIDRs or \"unix\"")
+		}
+		if err := checkProxies(p.TrustedProxies); err != nil {
+			return fmt.Errorf("proxy_auth.trusted_proxies: %w", err)
+		}
+		if strings.HasPrefix(c.Addr, "unix:") && !slices.Contains(p.TrustedProxies, trustedUnix) {
+			return errors.New("proxy_auth.trusted_proxies must include \"unix\" to trust the proxy on the unix socket")
+		}
+	}
+	return nil
+}
+
+// checkProxies returns an error if one of the trusted proxies isn't a CIDR or "unix".
+func checkProxies(proxies []string) error {
+	for _, cidr := range proxies {
+		if _, err := netip.ParsePrefix(cidr); err != nil && cidr != trustedUnix {
+			return fmt.Errorf("invalid CIDR \"%s\"", cidr)
+		}
+	}
+	return nil
+}
+
+// LoadConfig returns the validated configuration. The defaults are overridden by the config file (if path isn't empty),
+// then by environment variables and finally by the command line flags.
+func LoadConfig(path string, flags *flag.FlagSet) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		meta, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown setting \"%s\"", undecoded[0])
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	if flags != nil {
+		if err := c.applyFlags(flags); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
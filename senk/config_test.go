@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestProxyAuthTrusts(t *testing.T) {
+	tcp := ProxyAuthConfig{TrustedProxies: []string{"10.0.0.0/8", "::1/128"}}
+	unix := ProxyAuthConfig{TrustedProxies: []string{"unix"}}
+
+	tests := []struct {
+		config     ProxyAuthConfig
+		remoteAddr string
+		want       bool
+	}{
+		{tcp, "10.1.2.3:4000", true},
+		{tcp, "[::ffff:10.1.2.3]:4000", true},
+		{tcp, "[::1]:4000", true},
+		{tcp, "192.0.2.1:4000", false},
+		{tcp, "@", false},
+		{tcp, "", false},
+		{unix, "@", true},
+		{unix, "", true},
+		{unix, "127.0.0.1:4000", false},
+	}
+	for _, test := range tests {
+		if got := test.config.Trusts(test.remoteAddr); got != test.want {
+			t.Errorf("%q trusts %q = %v, want %v", test.config.TrustedProxies, test.remoteAddr, got, test.want)
+		}
+	}
+}
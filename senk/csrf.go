@@ -0,0 +1,64 @@
+// protection against cross-site request forgery
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRFMiddleware rejects state-changing requests which don't come from this server's pages. Browsers
+// send the Sec-Fetch-Site header, or at least the Origin or Referer one, which are checked in this order.
+// Requests with a bearer token are allowed, since browsers don't send it without being told to.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") || sameOriginRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		slog.WarnContext(r.Context(), "Rejected cross-site request", "origin", r.Header.Get("Origin"),
+			"referer", r.Header.Get("Referer"), "fetch_site", r.Header.Get("Sec-Fetch-Site"))
+		http.Error(w, "Cross-site request rejected", http.StatusForbidden)
+	})
+}
+
+func sameOriginRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none" // "none" if the user started the request, for example from a bookmark
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		return err == nil && sameOrigin(r, u)
+	}
+	if referer := r.Header.Get("Referer"); referer != "" {
+		u, err := url.Parse(referer)
+		return err == nil && sameOrigin(r, u)
+	}
+	return false
+}
+
+// sameOrigin returns true if the absolute URL points to the server which received the request.
+func sameOrigin(r *http.Request, u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// localRedirect returns the path (with the query) of the target, if it's a URL on this server,
+// or "/" otherwise. The target can be an absolute URL or an absolute path.
+func localRedirect(r *http.Request, target string) string {
+	u, err := url.Parse(target)
+	if err != nil || (u.IsAbs() || u.Host != "") && !sameOrigin(r, u) {
+		return "/"
+	}
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") || strings.ContainsRune(u.Path, '\\') {
+		return "/"
+	}
+	local := url.URL{Path: u.Path, RawQuery: u.RawQuery}
+	return local.String()
+}
@@ -5,37 +5,73 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 )
 
 type Database struct {
-	file     string // path to database file
-	Users    Users
-	Sessions Sessions
-	Metadata Metadata
-	storage  Storage
+	file      string // path to database file
+	Users     Users
+	Sessions  Sessions
+	Metadata  Metadata
+	Tokens    Tokens
+	Deletions Deletions
+	storage   Storage
+	auditLog  *AuditLog
+	dirSizes  dirSizes
+	lastSave  atomic.Int64 // unix time in nanoseconds of the last successful save
 }
 
 func (db *Database) Save() error {
+	_, err := db.saveSnapshot()
+	return err
+}
+
+// saveSnapshot saves the database and returns the saved data. The file is replaced atomically,
+// so that it's never left partially written.
+func (db *Database) saveSnapshot() ([]byte, error) {
+	start := time.Now()
+	defer func() { saveDuration.Observe(time.Since(start).Seconds()) }()
+
 	db.Users.mu.RLock()
 	defer db.Users.mu.RUnlock()
 	db.Sessions.mu.RLock()
 	defer db.Sessions.mu.RUnlock()
 	db.Metadata.mu.RLock()
 	defer db.Metadata.mu.RUnlock()
+	db.Tokens.mu.RLock()
+	defer db.Tokens.mu.RUnlock()
+	db.Deletions.mu.RLock()
+	defer db.Deletions.mu.RUnlock()
 
 	bytes, err := json.Marshal(db)
 	if err != nil {
-		log.Printf("Error marshalling database: %v", err)
-		return err
+		saveFailures.Inc()
+		slog.Error("Error marshalling database", "err", err)
+		return nil, err
+	}
+	err = os.WriteFile(db.file+".tmp", bytes, 0600)
+	if err == nil {
+		err = os.Rename(db.file+".tmp", db.file)
 	}
-	err = os.WriteFile(db.file, bytes, 0600)
 	if err != nil {
-		log.Printf("Error saving database: %v", err)
+		saveFailures.Inc()
+		slog.Error("Error saving database", "err", err)
+	} else {
+		db.lastSave.Store(time.Now().UnixNano())
 	}
-	return err
+	return bytes, err
+}
+
+// LastSave returns the time of the last successful save, zero if the database wasn't saved since it was loaded.
+func (db *Database) LastSave() time.Time {
+	if t := db.lastSave.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
 }
 
 func LoadDatabase(path string) (*Database, error) {
@@ -44,22 +80,28 @@ func LoadDatabase(path string) (*Database, error) {
 
 	bytes, err := os.ReadFile(db.file)
 	if errors.Is(err, os.ErrNotExist) {
-		log.Printf("Database file does not exist, will create.")
+		slog.Info("Database file does not exist, will create.")
 	} else if err != nil {
-		log.Printf("Error reading database: %v", err)
+		slog.Error("Error reading database", "err", err)
 		return nil, err
 	} else {
 		err = json.Unmarshal(bytes, &db)
 		if err != nil {
-			log.Printf("Error unmarshalling database: %v", err)
+			slog.Error("Error unmarshalling database", "err", err)
 			return nil, err
 		}
 	}
 
+	db.auditLog, err = OpenAuditLog(path)
+	if err != nil {
+		slog.Error("Error opening audit log", "err", err)
+		return nil, err
+	}
+
 	db.storage = InitStorage(path)
 	err = db.storage.LoadAll(db.Users.GetAllUsernames())
 	if err != nil {
-		log.Printf("Error initializing storage: %v", err)
+		slog.Error("Error initializing storage", "err", err)
 		return nil, err
 	}
 
@@ -68,3 +110,29 @@ func LoadDatabase(path string) (*Database, error) {
 
 	return &db, nil
 }
+
+// AddUser adds a user with the password and initializes their storage.
+func (db *Database) AddUser(username, password string) error {
+	if db.Deletions.Pending(username) {
+		return ErrDeleted
+	}
+	if err := db.Users.AddUser(username, password); err != nil {
+		return err
+	}
+	return db.RunStorageTask(func(s *Storage) error {
+		return s.AddStore(username)
+	})
+}
+
+// ProvisionUser adds a user without a password, who is authenticated by an identity provider, and initializes their storage.
+func (db *Database) ProvisionUser(username string) error {
+	if db.Deletions.Pending(username) {
+		return ErrDeleted
+	}
+	if err := db.Users.AddExternalUser(username); err != nil {
+		return err
+	}
+	return db.RunStorageTask(func(s *Storage) error {
+		return s.AddStore(username)
+	})
+}
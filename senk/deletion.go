@@ -0,0 +1,270 @@
+// deleting accounts
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DeletedDirName is the directory in the data directory with the archives of deleted users.
+const DeletedDirName = "_deleted"
+
+var ErrDeleted = errors.New("user was deleted, the username can't be used until the data is purged")
+
+// DeletedUser is a deleted user whose data is archived until the grace period is over.
+// The username can't be used for a new user until then.
+type DeletedUser struct {
+	Username string
+	Deleted  time.Time
+	Archive  string // directory in DeletedDirName
+}
+
+// PurgeTime returns when the archive is removed, with the current grace period.
+func (d DeletedUser) PurgeTime() time.Time {
+	return d.Deleted.Add(GetConfig().DeletionGracePeriod.Duration)
+}
+
+// userArchive is saved in the archive as "account.json". The notes are in the "notes" directory,
+// in the same format as the user's store, and the attachments in "blobs", named by their hashes.
+type userArchive struct {
+	User    User
+	Notes   map[string]NoteMeta   // indexed like in Metadata.Notes
+	Folders map[string]FolderMeta // indexed like in Metadata.Folders
+}
+
+type Deletions struct {
+	List []DeletedUser
+	mu   sync.RWMutex
+}
+
+func (deletions *Deletions) add(d DeletedUser) {
+	deletions.mu.Lock()
+	defer deletions.mu.Unlock()
+	deletions.List = append(deletions.List, d)
+}
+
+// Pending returns true if the user was deleted and wasn't purged yet.
+func (deletions *Deletions) Pending(username string) bool {
+	deletions.mu.RLock()
+	defer deletions.mu.RUnlock()
+	return slices.ContainsFunc(deletions.List, func(d DeletedUser) bool { return d.Username == username })
+}
+
+// GetAll returns a copy of the deleted users, the oldest first.
+func (deletions *Deletions) GetAll() []DeletedUser {
+	deletions.mu.RLock()
+	defer deletions.mu.RUnlock()
+	return slices.Clone(deletions.List)
+}
+
+func (deletions *Deletions) remove(archive string) {
+	deletions.mu.Lock()
+	defer deletions.mu.Unlock()
+	deletions.List = slices.DeleteFunc(deletions.List, func(d DeletedUser) bool { return d.Archive == archive })
+}
+
+// userArchive returns the user's account.json for the archive, and the hashes of their attachments.
+func (m *Metadata) userArchive(user User) (account []byte, blobs []string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	archive := userArchive{User: user, Notes: make(map[string]NoteMeta), Folders: make(map[string]FolderMeta)}
+	for k, n := range m.Notes {
+		if b, _, _ := strings.Cut(k, "/"); b == user.Username {
+			archive.Notes[k] = n
+			for _, a := range n.Attachments {
+				if !slices.Contains(blobs, a.Hash) {
+					blobs = append(blobs, a.Hash)
+				}
+			}
+		}
+	}
+	for k, f := range m.Folders {
+		if b, _, _ := strings.Cut(k, "/"); b == user.Username {
+			archive.Folders[k] = f
+		}
+	}
+	account, err = json.Marshal(archive)
+	return account, blobs, err
+}
+
+// RemoveUser removes the user's notes and folders, and removes the user from the shares of the other
+// users' notes and folders. It returns the hashes of the blobs which are no longer referenced.
+func (m *Metadata) RemoveUser(user string) (unreferenced []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var notes []NoteMeta
+	for k, n := range m.Notes {
+		if b, _, _ := strings.Cut(k, "/"); b == user {
+			notes = append(notes, n)
+			delete(m.Notes, k)
+		} else if _, ok := n.Shares[user]; ok {
+			delete(n.Shares, user)
+		}
+	}
+	for k, f := range m.Folders {
+		if b, _, _ := strings.Cut(k, "/"); b == user {
+			delete(m.Folders, k)
+		} else if _, ok := f.Shares[user]; ok {
+			delete(f.Shares, user)
+		}
+	}
+	m.titles = nil // rebuilt without the removed notes
+	for _, n := range notes {
+		for _, a := range n.Attachments {
+			if !m.blobReferenced(a.Hash) && !slices.Contains(unreferenced, a.Hash) {
+				unreferenced = append(unreferenced, a.Hash)
+			}
+		}
+	}
+	return
+}
+
+// archiveUser creates the archive directory with the user's account.json and attachments, then moves
+// their store into it. If it fails, the archive directory is removed and the store is left in place.
+// It must be run in the storage worker.
+func (s *Storage) archiveUser(dir, username string, account []byte, blobs []string) (err error) {
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0700); err != nil {
+		return err
+	}
+	for _, hash := range blobs {
+		err := linkOrCopy(s.blobPath(hash), filepath.Join(dir, "blobs", hash))
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to archive the attachments: %w", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "account.json"), account, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(s.Root, username), filepath.Join(dir, "notes")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to archive the notes: %w", err)
+	}
+	delete(s.UserStores, username)
+	return nil
+}
+
+// DeleteUser deletes the user, signs them out everywhere and revokes their tokens. Their notes, attachments
+// and metadata are moved into an archive, which is purged once the grace period is over. The user is only
+// removed once the archive is complete, if archiving fails nothing is changed.
+func (db *Database) DeleteUser(username string) error {
+	deleted := DeletedUser{Username: username, Deleted: time.Now()}
+	deleted.Archive = username + "-" + deleted.Deleted.Format(backupTimeFormat)
+	// In the storage worker, so that nothing is written to the store meanwhile.
+	err := db.RunStorageTask(func(s *Storage) error {
+		user, err := db.Users.GetUser(username)
+		if err != nil {
+			return err
+		}
+		account, blobs, err := db.Metadata.userArchive(user)
+		if err != nil {
+			return err
+		}
+		if err := s.archiveUser(filepath.Join(s.Root, DeletedDirName, deleted.Archive), username, account, blobs); err != nil {
+			return err
+		}
+		if _, err := db.Users.DeleteUser(username); err != nil {
+			return err
+		}
+		unreferenced := db.Metadata.RemoveUser(username)
+		// checked again, the same content could have been attached meanwhile
+		db.Metadata.RemoveUnreferencedBlobs(s, unreferenced)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	db.Sessions.InvalidateUserSessions(username)
+	db.Tokens.RevokeUser(username)
+	db.Deletions.add(deleted)
+	slog.Info("Deleted user", "username", username, "archive", deleted.Archive)
+	return nil
+}
+
+// PurgeDeletedUsers removes the archives of the deleted users whose grace period is over.
+func (db *Database) PurgeDeletedUsers(now time.Time) {
+	for _, d := range db.Deletions.GetAll() {
+		if now.Before(d.PurgeTime()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(db.storage.Root, DeletedDirName, d.Archive)); err != nil {
+			slog.Error("Error purging deleted user", "username", d.Username, "err", err)
+			continue
+		}
+		db.Deletions.remove(d.Archive)
+		db.auditLog.Record(AuditEntry{Action: AuditUserPurge, Target: d.Username})
+		slog.Info("Purged deleted user", "username", d.Username)
+	}
+}
+
+// deleteAccount deletes the signed in user, who has to confirm it with their password,
+// or with their username if they don't have one, and with the second factor if it's enabled.
+func (db *Database) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	p := newPage(r, "account-view")
+	if p.Username == "" {
+		http.Error(w, "Only authenticated users can delete their account", http.StatusForbidden)
+		return
+	}
+	user, err := db.Users.GetUser(p.Username)
+	if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		return
+	}
+	confirm := r.PostFormValue("confirm")
+	if user.PasswordHash != "" && !db.Users.CheckPassword(p.Username, confirm) || user.PasswordHash == "" && confirm != p.Username {
+		p.Error = "Confirm with your password, or with your username if you don't have one"
+		db.renderAccountPage(w, p, accountData{}, http.StatusForbidden)
+		return
+	}
+	if user.TOTP != nil && user.TOTP.Enabled {
+		if err := db.Users.CheckSecondFactor(p.Username, r.PostFormValue("code")); errors.Is(err, ErrTOTPLocked) {
+			p.Error = err.Error()
+			db.renderAccountPage(w, p, accountData{}, http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			db.audit(r.Context(), AuditEntry{Action: AuditSignInFailed, Target: p.Username, Detail: "totp"})
+			p.Error = "Confirm with a valid code or recovery code"
+			db.renderAccountPage(w, p, accountData{}, http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := db.DeleteUser(p.Username); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting user", "username", p.Username, "err", err)
+		p.Error = "Deleting the account failed, try again later"
+		db.renderAccountPage(w, p, accountData{}, http.StatusInternalServerError)
+		return
+	}
+	db.audit(r.Context(), AuditEntry{Action: AuditUserDelete, Target: p.Username, Detail: "self"})
+	clearSessionCookie(w, r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// adminDeleteUser deletes the user.
+// expects following chi URL params: username
+func (db *Database) adminDeleteUser(r *http.Request) error {
+	username := chi.URLParam(r, "username")
+	if _, session := GetSessionCtx(r.Context()); username == session.Data.Username {
+		return ErrSelfAdmin
+	}
+	if err := db.DeleteUser(username); err != nil {
+		return err
+	}
+	db.audit(r.Context(), AuditEntry{Action: AuditUserDelete, Target: username, Detail: "admin"})
+	return nil
+}
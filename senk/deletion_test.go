@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeleteUserArchiveFailure(t *testing.T) {
+	dir := t.TempDir()
+	db := &Database{storage: InitStorage(dir)}
+	db.Sessions.Initialize()
+	db.StartStorageWorker()
+	if err := db.ProvisionUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := db.Tokens.Create("alice", "script", ScopeRead, nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the archive can't be created when its parent is a file
+	if err := os.WriteFile(filepath.Join(dir, DeletedDirName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteUser("alice"); err == nil {
+		t.Fatal("deleting succeeded without an archive")
+	}
+	if _, err := db.Users.GetUser("alice"); err != nil {
+		t.Errorf("user was removed: %v", err)
+	}
+	if _, err := db.Tokens.Authenticate(secret); err != nil {
+		t.Errorf("token was revoked: %v", err)
+	}
+	if _, ok := db.storage.UserStores["alice"]; !ok {
+		t.Error("store was removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "alice")); err != nil {
+		t.Errorf("notes were moved: %v", err)
+	}
+	if db.Deletions.Pending("alice") {
+		t.Error("deletion was recorded")
+	}
+
+	if err := os.Remove(filepath.Join(dir, DeletedDirName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Users.GetUser("alice"); err == nil {
+		t.Error("user wasn't removed")
+	}
+	if _, err := db.Tokens.Authenticate(secret); err == nil {
+		t.Error("token wasn't revoked")
+	}
+	deleted := db.Deletions.GetAll()
+	if len(deleted) != 1 {
+		t.Fatalf("%d deletions recorded", len(deleted))
+	}
+	for _, name := range []string{"account.json", "notes"} {
+		if _, err := os.Stat(filepath.Join(dir, DeletedDirName, deleted[0].Archive, name)); err != nil {
+			t.Errorf("archive: %v", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// exporting notes as a zip archive
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atmatto/atylar"
+)
+
+const ManifestVersion = 1
+
+type ExportedVersion struct {
+	Generation uint64
+	File       string
+}
+
+type ExportedNote struct {
+	Id          string
+	File        string
+	Metadata    NoteMeta
+	History     []ExportedVersion `json:",omitempty"`
+	Attachments map[string]string `json:",omitempty"` // file name in the archive, indexed by the attachment name
+}
+
+// Manifest describes the contents of an export archive. It is stored in it as "manifest.json".
+type Manifest struct {
+	Version  int
+	User     string
+	Exported time.Time
+	Notes    []ExportedNote
+	Folders  []Folder
+}
+
+// readWithHistory reads the current content of the note and, if history is true,
+// all of its previous versions, indexed by the generation.
+func (db *Database) readWithHistory(user, id string, history bool) (content string, versions map[uint64]string, err error) {
+	read := func(store atylar.Store, generation uint64) (string, error) {
+		f, err := store.Open(id, generation)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		bytes, err := io.ReadAll(f)
+		return string(bytes), err
+	}
+
+	versions = make(map[uint64]string)
+	err = db.RunStorageTask(func(s *Storage) error {
+		store := s.UserStores[user]
+		var err error
+		content, err = read(store, 0)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if !history {
+			return nil
+		}
+		generations, err := store.History(id)
+		if err != nil {
+			return err
+		}
+		for _, g := range generations {
+			if versions[g], err = read(store, g); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// writeZipFile adds a file to the archive.
+func writeZipFile(zw *zip.Writer, name string, modified time.Time, content io.Reader) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	return err
+}
+
+// Export writes a zip archive with all of the user's notes (including the trash) as markdown files,
+// their attachments and a manifest with their metadata. If history is true, previous versions
+// of the notes are included too.
+func (db *Database) Export(w io.Writer, user string, history bool) error {
+	notes := append(db.Metadata.GetUserNotes(user), db.Metadata.GetUserTrash(user)...)
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Metadata.Creation.Before(notes[j].Metadata.Creation) })
+
+	manifest := Manifest{
+		Version:  ManifestVersion,
+		User:     user,
+		Exported: time.Now(),
+		Notes:    []ExportedNote{},
+		Folders:  db.Metadata.GetUserFolders(user, "", user, true),
+	}
+
+	zw := zip.NewWriter(w)
+	for _, n := range notes {
+		id := n.Path[len(user)+1:]
+		content, versions, err := db.readWithHistory(user, id, history)
+		if err != nil {
+			return fmt.Errorf("failed to read note ~%s: %w", n.Path, err)
+		}
+
+		dir := "notes"
+		if n.Metadata.Deleted {
+			dir = "trash"
+		}
+		e := ExportedNote{Id: id, File: fmt.Sprintf("%s/%s.md", dir, id), Metadata: n.Metadata}
+		if err := writeZipFile(zw, e.File, n.Metadata.Modification, strings.NewReader(content)); err != nil {
+			return err
+		}
+
+		generations := make([]uint64, 0, len(versions))
+		for g := range versions {
+			generations = append(generations, g)
+		}
+		sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+		for _, g := range generations {
+			v := ExportedVersion{g, fmt.Sprintf("history/%s@%d.md", id, g)}
+			if err := writeZipFile(zw, v.File, n.Metadata.Modification, strings.NewReader(versions[g])); err != nil {
+				return err
+			}
+			e.History = append(e.History, v)
+		}
+
+		for name, a := range n.Metadata.Attachments {
+			if e.Attachments == nil {
+				e.Attachments = make(map[string]string)
+			}
+			e.Attachments[name] = fmt.Sprintf("files/%s/%s", id, name)
+			f, err := db.storage.OpenBlob(a.Hash)
+			if err != nil {
+				return fmt.Errorf("failed to open attachment %s of note ~%s: %w", name, n.Path, err)
+			}
+			err = writeZipFile(zw, e.Attachments[name], a.Created, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		manifest.Notes = append(manifest.Notes, e)
+	}
+
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.Exported})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
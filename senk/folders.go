@@ -0,0 +1,181 @@
+// folders (notebooks) grouping notes
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxFolderDepth limits the nesting of folders.
+const MaxFolderDepth = 32
+
+var (
+	ErrFolderNotExist    = errors.New("folder does not exist")
+	ErrFolderCycle       = errors.New("folder can't be moved into itself")
+	ErrFolderDepth       = errors.New("folders are nested too deeply")
+	ErrInvalidFolderName = errors.New("folder name must contain between 1 and 100 characters")
+)
+
+type FolderMeta struct {
+	Owner    string
+	Name     string
+	Parent   string // id of the parent folder, empty for top-level folders
+	Public   PermissionLevel
+	Shares   map[string]PermissionLevel // permissions of specific users, indexed by the username
+	Creation time.Time
+}
+
+type Folder struct {
+	Path     string
+	Metadata FolderMeta
+}
+
+// GetPermissions returns the user's permission level for the folder,
+// taking into account the permissions inherited from the parent folders.
+func (f *FolderMeta) GetPermissions(user string, folders map[string]FolderMeta) PermissionLevel {
+	n := NoteMeta{Owner: f.Owner, Folder: f.Parent, Public: f.Public, Shares: f.Shares}
+	return n.GetPermissions(user, folders)
+}
+
+func CheckFolderName(name string) error {
+	if l := len(strings.TrimSpace(name)); l < 1 || l > 100 {
+		return ErrInvalidFolderName
+	}
+	return nil
+}
+
+func (m *Metadata) GetFolder(user, id string) (FolderMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.Folders[fmt.Sprintf("%s/%s", user, id)]
+	if !ok {
+		return FolderMeta{}, ErrFolderNotExist
+	}
+	return f, nil
+}
+
+// checkParent returns an error if the folder with the given id can't be placed in the parent folder.
+// The caller must hold the lock.
+func (m *Metadata) checkParent(user, id, parent string) error {
+	depth := 0
+	for p := parent; p != ""; depth++ {
+		if p == id {
+			return ErrFolderCycle
+		}
+		if depth >= MaxFolderDepth {
+			return ErrFolderDepth
+		}
+		f, ok := m.Folders[fmt.Sprintf("%s/%s", user, p)]
+		if !ok {
+			return ErrFolderNotExist
+		}
+		p = f.Parent
+	}
+	return nil
+}
+
+// AddFolder adds a new folder with the given id. The parent folder must exist.
+func (m *Metadata) AddFolder(user, id string, folder FolderMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	if _, ok := m.Folders[key]; ok {
+		return ErrIdUsed
+	}
+	if err := m.checkParent(user, id, folder.Parent); err != nil {
+		return err
+	}
+	m.Folders[key] = folder
+	return nil
+}
+
+// SetFolder replaces the folder's metadata, checking that it isn't moved into itself.
+func (m *Metadata) SetFolder(user, id string, folder FolderMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	if _, ok := m.Folders[key]; !ok {
+		return ErrFolderNotExist
+	}
+	if err := m.checkParent(user, id, folder.Parent); err != nil {
+		return err
+	}
+	m.Folders[key] = folder
+	return nil
+}
+
+// DeleteFolder removes the folder, moving its notes and subfolders into its parent.
+func (m *Metadata) DeleteFolder(user, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	folder, ok := m.Folders[key]
+	if !ok {
+		return ErrFolderNotExist
+	}
+	for k, n := range m.Notes {
+		if b, _, _ := strings.Cut(k, "/"); b == user && n.Folder == id {
+			n.Folder = folder.Parent
+			m.Notes[k] = n
+		}
+	}
+	for k, f := range m.Folders {
+		if b, _, _ := strings.Cut(k, "/"); b == user && f.Parent == id {
+			f.Parent = folder.Parent
+			m.Folders[k] = f
+		}
+	}
+	delete(m.Folders, key)
+	return nil
+}
+
+// MoveNote moves the note into the folder. An empty folder id moves it to the top level.
+func (m *Metadata) MoveNote(user, id, folder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if folder != "" {
+		if _, ok := m.Folders[fmt.Sprintf("%s/%s", user, folder)]; !ok {
+			return ErrFolderNotExist
+		}
+	}
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta := m.Notes[key]
+	meta.Folder = folder
+	m.Notes[key] = meta
+	return nil
+}
+
+// SetNotePermissions sets the public permission and the shares of the note.
+func (m *Metadata) SetNotePermissions(user, id string, public PermissionLevel, shares map[string]PermissionLevel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta := m.Notes[key]
+	meta.Public = public
+	meta.Shares = shares
+	m.Notes[key] = meta
+}
+
+// GetUserFolders returns the user's folders which are direct children of the parent
+// (or all of them if all is true) and which the accessor can see.
+func (m *Metadata) GetUserFolders(user, parent, accessor string, all bool) []Folder {
+	folders := make([]Folder, 0)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, f := range m.Folders {
+		if b, _, _ := strings.Cut(k, "/"); b != user {
+			continue
+		}
+		if !all && f.Parent != parent {
+			continue
+		}
+		if f.GetPermissions(accessor, m.Folders) == PermissionNone {
+			continue
+		}
+		folders = append(folders, Folder{k, f})
+	}
+	return folders
+}
@@ -0,0 +1,30 @@
+// security headers
+
+package main
+
+import "net/http"
+
+// contentSecurityPolicy only allows the app's own scripts and styles, so that injected markup can't run scripts.
+// Images are only loaded from the server, so that notes can't reveal their readers to other sites.
+const contentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self' data:; " +
+	"connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'"
+
+// remoteImagesPolicy also allows images from other sites over HTTPS, if it's enabled in the config.
+const remoteImagesPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self' data: https:; " +
+	"connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'"
+
+// SecurityHeaders sets the headers which restrict what browsers do with the responses.
+func SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if GetConfig().RemoteImages {
+			h.Set("Content-Security-Policy", remoteImagesPolicy)
+		} else {
+			h.Set("Content-Security-Policy", contentSecurityPolicy)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY") // for browsers which don't support frame-ancestors
+		h.Set("Referrer-Policy", "same-origin")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,3 +1,13 @@
+// Data embedded in the page by the server, used instead of fetching it on the first build.
+let initial = JSON.parse(document.getElementById("initial")?.textContent || "null")
+document.documentElement.classList.add("js")
+
+const takeInitial = () => {
+	const data = initial
+	initial = null
+	return data?.Path === document.location.pathname ? data : null
+}
+
 let editorState = {
 	modified: false, // TODO: Mark unsaved changes
 	intervalID: 0,
@@ -83,7 +93,12 @@ const buildIndex = (data, trash = false, side = false) => {
 	const list = add(main, "ul", "", { className: "index" + (side ? " side" : "")})
 	for (const note of data) {
 		const path = (trash ? "/trash" : "") + "/~" + note["Path"]
-		add(add(list, "li"), "a", "~" + note["Path"], {href: path})
+		const item = add(list, "li")
+		add(item, "a", "~" + note["Path"], {href: path})
+		const tags = new Set([...(note["Metadata"]["Tags"] ?? []), ...(note["Metadata"]["Hashtags"] ?? [])])
+		if (tags.size !== 0) {
+			add(item, "span", " " + [...tags].sort().map(t => "#" + t).join(" "), {className: "tags"})
+		}
 	}
 	if (!trash)
 		add(add(list, "li"), "a", "Trash", {href: "/trash"})
@@ -92,7 +107,10 @@ const buildIndex = (data, trash = false, side = false) => {
 const getIndex = (user) => {
 	const main = document.getElementsByTagName("main")[0]
 	main.replaceChildren([])
-	if (user === "") { // Get the index for the current user
+	const data = takeInitial()
+	if (data?.Index !== undefined) {
+		buildIndex(data.Index)
+	} else if (user === "") { // Get the index for the current user
 		fetch("/api/index")
 			.then(resp => {
 				if (!resp.ok) {
@@ -124,6 +142,11 @@ const getIndex = (user) => {
 const getTrash = () => {
 	const main = document.getElementsByTagName("main")[0]
 	main.replaceChildren([])
+	const data = takeInitial()
+	if (data?.Index !== undefined) {
+		buildIndex(data.Index, true)
+		return
+	}
 	fetch("/api/trash")
 		.then(resp => {
 			if (!resp.ok) {
@@ -140,6 +163,10 @@ const getTrash = () => {
 
 const getTrashNote = (user, id) => {
 	const main = document.getElementsByTagName("main")[0]
+	const data = takeInitial()
+	if (data?.Content !== undefined && document.querySelector("main > .rendered") !== null) {
+		return // keep the read-only note rendered by the server
+	}
 	main.replaceChildren([])
 	const path = "/trash/" + user + "/" + id
 	fetch(path + "/raw")
@@ -151,7 +178,7 @@ const getTrashNote = (user, id) => {
 			return resp.text()
 		})
 		.then(data => {
-			buildEditor(path, data) // TODO: Read-only, restore from trash
+			buildEditor(path, data) // TODO: Read-only
 		})
 		.catch(err => showError("Error getting note: " + err.message))
 }
@@ -177,12 +204,45 @@ const buildEditor = (path, data) => {
 	editor.oninput = () => {
 		editorState.modified = true
 	}
+	editor.onpaste = (e) => {
+		const files = [...e.clipboardData.files]
+		if (files.length !== 0 && !path.startsWith("/trash/")) {
+			e.preventDefault()
+			files.forEach(uploadAttachment(path, editor))
+		}
+	}
+}
+
+// uploadAttachment returns a function which uploads the file as the note's attachment
+// and inserts a link to it into the editor at the cursor.
+const uploadAttachment = (path, editor) => (file, i) => {
+	const ext = file.name.includes(".") ? file.name.split(".").pop() : file.type.split("/").pop()
+	const name = "pasted-" + Date.now() + "-" + i + "." + ext.replace(/[^A-Za-z0-9]/g, "")
+	const url = path + "/files/" + name
+	fetch(url, {method: "POST", body: file})
+		.then(resp => {
+			if (!resp.ok) {
+				throw new Error(resp.status + " " + resp.statusText)
+			}
+			const link = (file.type.startsWith("image/") ? "!" : "") + "[" + name + "](" + url + ")"
+			editor.setRangeText(link, editor.selectionStart, editor.selectionEnd, "end")
+			editorState.modified = true
+		})
+		.catch(err => showError("Error uploading attachment: " + err.message))
 }
 
 const getNote = (user, id) => {
 	const main = document.getElementsByTagName("main")[0]
+	const data = takeInitial()
+	if (data?.Content !== undefined && document.querySelector("main > .rendered") !== null) {
+		return // keep the read-only note rendered by the server
+	}
 	main.replaceChildren([])
 	const path = "/" + user + "/" + id
+	if (data?.Content !== undefined) {
+		buildEditor(path, data.Content)
+		return
+	}
 	fetch(path + "/raw")
 		.then(resp => {
 			if (!resp.ok) {
@@ -221,6 +281,7 @@ const build = (path) => {
 			title.replaceChildren(add(null, "span", "(trash) "), add(null, "a", path[1], {href: "/"+path[1]}), add(null, "span", "/"+path[2]))
 			header.classList.remove("notitle")
 			document.body.className = "trashnote-view"
+			document.getElementById("restoreform").action = "/trash/" + path[1] + "/" + path[2] + "/restore"
 			break
 		}
 	} else {
@@ -241,10 +302,12 @@ const build = (path) => {
 			title.replaceChildren(add(null, "a", path[0], {href: "/"+path[0]}), add(null, "span", "/"+path[1]))
 			header.classList.remove("notitle")
 			document.body.className = "note-view"
-			document.getElementById("rawbtn").onclick = () => {
+			document.getElementById("rawbtn").onclick = (e) => {
+				e.preventDefault()
 				goto(document.location + "/raw", false)
 			}
-			document.getElementById("deletebtn").onclick = () => {
+			document.getElementById("deletebtn").onclick = (e) => {
+				e.preventDefault()
 				fetch(document.location, {method: "DELETE"})
 					.then(resp => {
 						if (!resp.ok) {
@@ -255,7 +318,8 @@ const build = (path) => {
 					})
 					.catch(err => showError("Error deleting note: " + err.message))
 			}
-			document.getElementById("newbtn").onclick = () => {
+			document.getElementById("newbtn").onclick = (e) => {
+				e.preventDefault()
 				fetch("/api/new", {method: "POST"})
 					.then(resp => {
 						if (!resp.ok) {
@@ -272,6 +336,10 @@ const build = (path) => {
 }
 
 window.onload = () => {
+	document.getElementById("statusclose").onclick = () => document.getElementById("status").classList.add("inactive")
+	if (document.body.className === "account-view" || document.body.className === "admin-view") {
+		return // served by the server, the links reload the page
+	}
 	document.getElementById("senk").onclick = onLinkClick
 	build(document.location.pathname)
 }
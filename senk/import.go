@@ -0,0 +1,262 @@
+// importing notes from a directory or a zip archive of markdown files
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	MaxImportSize      = 100 << 20 // 100 MiB, of the uploaded archive
+	MaxImportFileSize  = 10 << 20  // 10 MiB, of a single file once it's decompressed
+	MaxImportTotalSize = 200 << 20 // 200 MiB, of all the files once they're decompressed
+)
+
+var (
+	ErrImportFileSize  = errors.New("file is larger than 10 MiB")
+	ErrImportTotalSize = errors.New("files are larger than 200 MiB in total")
+)
+
+// markdownLinkPattern matches the destination of inline markdown links and images, "[label](destination)".
+var markdownLinkPattern *regexp.Regexp = regexp.MustCompile(`(\]\()([^)\s]+)(\))`)
+
+// frontMatterTimeFormats are tried in order when parsing dates from the front matter.
+var frontMatterTimeFormats = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+type ImportedNote struct {
+	File string
+	Path string `json:",omitempty"` // path of the created note, "user/id"
+	Err  string `json:",omitempty"`
+}
+
+// importFile is a note to be imported.
+type importFile struct {
+	name     string // path in the imported file system
+	id       string
+	content  string
+	created  time.Time
+	modified time.Time
+	tags     []string
+}
+
+// parseFrontMatter splits the YAML front matter (delimited with "---" lines) from the content
+// and returns the values of the simple "key: value" entries.
+func parseFrontMatter(content string) (map[string]string, string) {
+	values := make(map[string]string)
+	if !strings.HasPrefix(content, "---\n") {
+		return values, content
+	}
+	front, body, ok := strings.Cut(content[4:], "\n---\n")
+	if !ok {
+		return values, content
+	}
+	for _, line := range strings.Split(front, "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			values[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+	return values, body
+}
+
+func parseFrontMatterTime(value string) (time.Time, bool) {
+	for _, f := range frontMatterTimeFormats {
+		if t, err := time.Parse(f, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseImportFile reads the file and its metadata from the front matter, falling back to the file's modification time.
+// Files larger than MaxImportFileSize aren't read, the size given by an archive isn't relied upon.
+func parseImportFile(fsys fs.FS, name string) (importFile, error) {
+	f := importFile{name: name}
+	file, err := fsys.Open(name)
+	if err != nil {
+		return f, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return f, err
+	}
+	if info.Size() > MaxImportFileSize {
+		return f, ErrImportFileSize
+	}
+	bytes, err := io.ReadAll(io.LimitReader(file, MaxImportFileSize+1))
+	if err != nil {
+		return f, err
+	} else if len(bytes) > MaxImportFileSize {
+		return f, ErrImportFileSize
+	}
+	f.created, f.modified = info.ModTime(), info.ModTime()
+
+	values, content := parseFrontMatter(strings.ReplaceAll(string(bytes), "\r\n", "\n"))
+	f.content = content
+	for _, k := range []string{"created", "date"} {
+		if t, ok := parseFrontMatterTime(values[k]); ok {
+			f.created, f.modified = t, t
+			break
+		}
+	}
+	for _, k := range []string{"updated", "modified", "lastmod"} {
+		if t, ok := parseFrontMatterTime(values[k]); ok {
+			f.modified = t
+			break
+		}
+	}
+	if title := values["title"]; title != "" && ParseTitle(content) != title {
+		f.content = "# " + title + "\n\n" + content
+	}
+	for _, t := range strings.FieldsFunc(strings.Trim(values["tags"], "[]"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if tag, err := NormalizeTag(t); err == nil {
+			f.tags = append(f.tags, tag)
+		}
+	}
+	return f, nil
+}
+
+// rewriteLinks replaces relative links to other imported files with links to the created notes.
+func rewriteLinks(content, name, user string, ids map[string]string) string {
+	return markdownLinkPattern.ReplaceAllStringFunc(content, func(s string) string {
+		m := markdownLinkPattern.FindStringSubmatch(s)
+		dest, fragment, _ := strings.Cut(m[2], "#")
+		if dest == "" || strings.Contains(dest, ":") || strings.HasPrefix(dest, "/") {
+			return s // not a relative link
+		}
+		target := path.Join(path.Dir(name), dest)
+		id, ok := ids[target]
+		if !ok {
+			id, ok = ids[target+".md"]
+		}
+		if !ok {
+			return s
+		}
+		link := fmt.Sprintf("/~%s/%s", user, id)
+		if fragment != "" {
+			link += "#" + fragment
+		}
+		return m[1] + link + m[3]
+	})
+}
+
+// Import creates a note for every markdown or text file in the file system (for example
+// a directory or a zip archive). Subdirectories become folders inside the given folder.
+// Relative links between the files are rewritten to point to the created notes.
+// All files are read before anything is created, so an import failing with an error
+// (for example ErrImportTotalSize) doesn't leave anything behind.
+func (db *Database) Import(ctx context.Context, fsys fs.FS, user, folder string) ([]ImportedNote, error) {
+	result := []ImportedNote{}
+	files := []importFile{}
+	dirs := []string{}
+	var total int64
+
+	depth := 0 // of the folder the notes are imported into
+	for p := folder; p != ""; depth++ {
+		f, err := db.Metadata.GetFolder(user, p)
+		if err != nil {
+			return result, err
+		}
+		p = f.Parent
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != "." && (strings.HasPrefix(d.Name(), ".") || d.Name() == "__MACOSX") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			if name == "." {
+				return nil
+			}
+			if depth+strings.Count(name, "/")+1 > MaxFolderDepth {
+				return fmt.Errorf("%s: %w", name, ErrFolderDepth)
+			}
+			dirs = append(dirs, name) // parents come first
+			return nil
+		}
+
+		if ext := strings.ToLower(path.Ext(name)); ext != ".md" && ext != ".markdown" && ext != ".txt" {
+			return nil
+		}
+		f, err := parseImportFile(fsys, name)
+		if err != nil {
+			result = append(result, ImportedNote{File: name, Err: err.Error()})
+			return nil
+		}
+		if total += int64(len(f.content)); total > MaxImportTotalSize {
+			return ErrImportTotalSize
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	folders := map[string]string{".": folder} // folder ids, indexed by the directory
+	for _, name := range dirs {
+		id := uuid.NewString()
+		err := db.Metadata.AddFolder(user, id, FolderMeta{
+			Owner:    user,
+			Name:     path.Base(name),
+			Parent:   folders[path.Dir(name)],
+			Public:   PermissionInherit,
+			Creation: time.Now(),
+		})
+		if err != nil {
+			return result, fmt.Errorf("failed to create folder for %s: %w", name, err)
+		}
+		folders[name] = id
+	}
+
+	ids := make(map[string]string) // note ids, indexed by the file name
+	for i := range files {
+		id, err := db.NewNote(ctx, user, folders[path.Dir(files[i].name)])
+		if err != nil {
+			return result, fmt.Errorf("failed to create note for %s: %w", files[i].name, err)
+		}
+		files[i].id = id
+		ids[files[i].name] = id
+	}
+
+	// The notes are written once all of them have ids, so that the links can be rewritten.
+	for _, f := range files {
+		respc := make(chan error)
+		db.storage.Writes <- NoteWrite{
+			user:    user,
+			owner:   user,
+			id:      f.id,
+			content: rewriteLinks(f.content, f.name, user, ids),
+			ctx:     ctx,
+			queued:  db.storage.enqueue(),
+			resp:    respc,
+		}
+		if err := <-respc; err != nil {
+			result = append(result, ImportedNote{File: f.name, Err: err.Error()})
+			continue
+		}
+		if f.tags != nil {
+			db.Metadata.SetTags(user, f.id, f.tags)
+		}
+		db.Metadata.SetNoteTimes(user, f.id, f.created, f.modified)
+		result = append(result, ImportedNote{File: f.name, Path: fmt.Sprintf("%s/%s", user, f.id)})
+	}
+	return result, nil
+}
@@ -0,0 +1,261 @@
+// links between notes
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// wikiLinkPattern matches "[[target]]" and "[[target|label]]". The target is either a note title,
+// a note id, or one of them prefixed with "~user/" to link to another user's note.
+var wikiLinkPattern *regexp.Regexp = regexp.MustCompile(`\[\[([^\[\]|\n]+)(?:\|[^\[\]\n]*)?\]\]`)
+
+// pathLinkPattern matches relative links to notes, such as "/~user/id".
+var pathLinkPattern *regexp.Regexp = regexp.MustCompile(`(?:^|[\s(<"'\[])/~([a-z][a-z0-9_-]+)/([A-Za-z0-9_-]+)`)
+
+type Link struct {
+	Text   string // link as written in the content, e.g. "[[title]]" or "/~user/id"
+	Target string // path of the linked note ("user/id"), empty if it doesn't exist
+}
+
+// ParseTitle returns the title of the note, which is its first non-empty line without the heading markers.
+func ParseTitle(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if line == "" {
+			continue
+		}
+		if utf8.RuneCountInString(line) > 200 {
+			line = string([]rune(line)[:200])
+		}
+		return line
+	}
+	return ""
+}
+
+// ParseLinks returns the links found in the content, without duplicates. The targets are not resolved.
+func ParseLinks(content string) []Link {
+	links := []Link{}
+	seen := make(map[string]bool)
+	for _, m := range wikiLinkPattern.FindAllStringSubmatch(content, -1) {
+		text := "[[" + strings.TrimSpace(m[1]) + "]]"
+		if !seen[text] {
+			seen[text] = true
+			links = append(links, Link{Text: text})
+		}
+	}
+	for _, m := range pathLinkPattern.FindAllStringSubmatch(content, -1) {
+		text := fmt.Sprintf("/~%s/%s", m[1], m[2])
+		if !seen[text] {
+			seen[text] = true
+			links = append(links, Link{Text: text})
+		}
+	}
+	return links
+}
+
+// titleKey returns the key of Metadata.titles for the owner's notes with the title.
+func titleKey(owner, title string) string {
+	return owner + "/" + strings.ToLower(title)
+}
+
+// notesWithTitle returns the paths of the owner's notes with the title, ignoring case. The index is built on
+// first use and kept up to date by SetContentLinks. It can still have paths of removed or renamed notes,
+// those are skipped. The caller must hold the write lock.
+func (m *Metadata) notesWithTitle(owner, title string) []string {
+	if m.titles == nil {
+		m.titles = make(map[string][]string)
+		for k, n := range m.Notes {
+			if n.Title != "" {
+				m.titles[titleKey(n.Owner, n.Title)] = append(m.titles[titleKey(n.Owner, n.Title)], k)
+			}
+		}
+	}
+	paths := []string{}
+	for _, k := range m.titles[titleKey(owner, title)] {
+		if n, ok := m.Notes[k]; ok && n.Owner == owner && strings.EqualFold(n.Title, title) {
+			paths = append(paths, k)
+		}
+	}
+	return paths
+}
+
+// setTitle updates the note's entry in the title index. The caller must hold the write lock.
+func (m *Metadata) setTitle(key, owner, previous, title string) {
+	if m.titles == nil || strings.EqualFold(previous, title) {
+		return
+	}
+	if previous != "" {
+		m.titles[titleKey(owner, previous)] = slices.DeleteFunc(m.titles[titleKey(owner, previous)], func(k string) bool { return k == key })
+	}
+	if title != "" {
+		m.titles[titleKey(owner, title)] = append(m.titles[titleKey(owner, title)], key)
+	}
+}
+
+// linkTarget returns the owner and the title or id of the note the link points to, relative to the
+// owner of the note containing it. path is true for "/~user/id" links, which can only point to an id.
+func linkTarget(owner, text string) (targetOwner, target string, path bool) {
+	if strings.HasPrefix(text, "/~") {
+		u, id, _ := strings.Cut(text[2:], "/")
+		return u, id, true
+	}
+	target = strings.TrimSuffix(strings.TrimPrefix(text, "[["), "]]")
+	if strings.HasPrefix(target, "~") {
+		if u, t, ok := strings.Cut(target[1:], "/"); ok {
+			return u, t, false
+		}
+	}
+	return owner, target, false
+}
+
+// resolveLink returns the path of the note the link points to, or an empty string. Links are resolved
+// relative to the owner of the note containing them, and only to notes which the owner can read. If several
+// notes have the linked title, the oldest one is chosen. The caller must hold the write lock.
+func (m *Metadata) resolveLink(owner, text string) string {
+	readable := func(n NoteMeta) bool { return n.GetPermissions(owner, m.Folders) >= PermissionRead }
+
+	u, target, path := linkTarget(owner, text)
+	key := fmt.Sprintf("%s/%s", u, target)
+	if n, ok := m.Notes[key]; ok && (path || !n.Deleted) && readable(n) {
+		return key
+	}
+	if path {
+		return ""
+	}
+
+	resolved := ""
+	for _, k := range m.notesWithTitle(u, target) {
+		n := m.Notes[k]
+		if n.Deleted || !readable(n) {
+			continue
+		}
+		if r := m.Notes[resolved]; resolved == "" || n.Creation.Before(r.Creation) || n.Creation.Equal(r.Creation) && k < resolved {
+			resolved = k
+		}
+	}
+	return resolved
+}
+
+// SetContentLinks updates the note's title and links parsed from its content. Links which were
+// already resolved keep pointing to the same note, so they don't break when the target is renamed.
+// Dangling links in other notes which match the new title are resolved.
+func (m *Metadata) SetContentLinks(user, id, title string, links []Link) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta := m.Notes[key]
+
+	previous := make(map[string]string)
+	for _, l := range meta.Links {
+		previous[l.Text] = l.Target
+	}
+
+	m.setTitle(key, user, meta.Title, title)
+	meta.Title = title
+	m.Notes[key] = meta
+
+	for i, l := range links {
+		if t, ok := previous[l.Text]; ok && t != "" {
+			if n, exists := m.Notes[t]; exists && n.GetPermissions(user, m.Folders) >= PermissionRead {
+				links[i].Target = t
+				continue
+			}
+		}
+		links[i].Target = m.resolveLink(user, l.Text)
+	}
+	meta.Links = links
+	m.Notes[key] = meta
+
+	if title == "" {
+		return
+	}
+	for k, n := range m.Notes {
+		changed := false
+		for i, l := range n.Links {
+			if l.Target != "" {
+				continue
+			}
+			// only links which could point to the note are resolved again
+			u, target, path := linkTarget(n.Owner, l.Text)
+			if u != user || target != id && (path || !strings.EqualFold(target, title)) {
+				continue
+			}
+			if m.resolveLink(n.Owner, l.Text) == key {
+				n.Links[i].Target = key
+				changed = true
+			}
+		}
+		if changed {
+			m.Notes[k] = n
+		}
+	}
+}
+
+// GetBacklinks returns the notes linking to the given one which the accessor can read.
+func (m *Metadata) GetBacklinks(user, id, accessor string) []Note {
+	notes := make([]Note, 0)
+	key := fmt.Sprintf("%s/%s", user, id)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, n := range m.Notes {
+		if n.Deleted || n.GetPermissions(accessor, m.Folders) < PermissionRead {
+			continue
+		}
+		for _, l := range n.Links {
+			if l.Target == key {
+				notes = append(notes, Note{k, n})
+				break
+			}
+		}
+	}
+	return notes
+}
+
+type GraphNode struct {
+	Path  string
+	Title string
+}
+
+type GraphEdge struct {
+	From string
+	To   string
+}
+
+type Graph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+// GetGraph returns the link graph of the notes which the accessor can read. If user isn't empty,
+// only that user's notes are included.
+func (m *Metadata) GetGraph(user, accessor string) Graph {
+	g := Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	visible := make(map[string]bool)
+	for k, n := range m.Notes {
+		if n.Deleted || (user != "" && n.Owner != user) {
+			continue
+		}
+		if n.GetPermissions(accessor, m.Folders) >= PermissionRead {
+			visible[k] = true
+			g.Nodes = append(g.Nodes, GraphNode{k, n.Title})
+		}
+	}
+	for k := range visible {
+		linked := make(map[string]bool)
+		for _, l := range m.Notes[k].Links {
+			if visible[l.Target] && !linked[l.Target] {
+				linked[l.Target] = true
+				g.Edges = append(g.Edges, GraphEdge{k, l.Target})
+			}
+		}
+	}
+	return g
+}
@@ -0,0 +1,85 @@
+// listening on tcp and unix sockets, or on sockets passed by systemd
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// RedirectSocketName is the FileDescriptorName of the socket for the HTTPS redirect server,
+// when using socket activation. Other sockets are used by the main server.
+const RedirectSocketName = "redirect"
+
+type namedListener struct {
+	name string
+	net.Listener
+}
+
+// activatedListener returns the first of the listeners passed by systemd, for which
+// the name does or doesn't (depending on match) equal name.
+func activatedListener(listeners []namedListener, name string, match bool) net.Listener {
+	for _, l := range listeners {
+		if (l.name == name) == match {
+			return l.Listener
+		}
+	}
+	return nil
+}
+
+// Listen listens on the address, which can be a tcp address or "unix:" followed by the path of a unix socket.
+// The socket is given the configured mode and group.
+func Listen(addr string, c *Config) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := addr[len("unix:"):]
+	// Remove a socket left behind by a previous process which didn't exit cleanly.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := strconv.ParseUint(c.SocketMode, 8, 32) // validated with the config
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if c.SocketGroup != "" {
+		g, err := user.LookupGroup(c.SocketGroup)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// checkSocketMode returns an error if the mode isn't an octal permission mode.
+func checkSocketMode(mode string) error {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return errors.New("socket_mode must be an octal permission mode, for example \"0660\"")
+	}
+	return nil
+}
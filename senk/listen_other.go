@@ -0,0 +1,10 @@
+//go:build !unix
+
+// socket activation is only supported on unix systems
+
+package main
+
+// SystemdListeners returns no listeners, there is no socket activation on this system.
+func SystemdListeners() ([]namedListener, error) {
+	return nil, nil
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+// sockets passed by systemd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// systemdFdStart is the first file descriptor passed with socket activation, see sd_listen_fds(3).
+const systemdFdStart = 3
+
+// SystemdListeners returns the listeners passed by systemd socket activation, in order.
+// The environment variables are unset, so that they aren't inherited by child processes.
+func SystemdListeners() ([]namedListener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil // not activated, or the variables are meant for another process
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS \"%s\"", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := []namedListener{}
+	for i := 0; i < n; i++ {
+		fd := systemdFdStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if len(names) == n {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close() // FileListener duplicates the descriptor
+		if err != nil {
+			return nil, fmt.Errorf("file descriptor %d (%s) is not a listening socket: %w", fd, name, err)
+		}
+		listeners = append(listeners, namedListener{name, l})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,28 @@
+// locking the data directory
+
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// lockFileName is the file in the data directory which the server keeps locked. It starts
+// with a dot, so that restoring a backup leaves it in place.
+const lockFileName = ".lock"
+
+var ErrDirLocked = errors.New("the data directory is used by another process")
+
+// lockDataDir locks the data directory for a command which modifies the data, logging the error.
+// The returned function releases the lock.
+func lockDataDir(dir string) (func(), bool) {
+	unlock, err := lockDir(dir)
+	if errors.Is(err, ErrDirLocked) {
+		log.Printf("The data directory is in use, stop the server first")
+		return nil, false
+	} else if err != nil {
+		log.Printf("Failed to lock the data directory: %v", err)
+		return nil, false
+	}
+	return unlock, true
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+// the data directory isn't locked on other systems
+
+package main
+
+// lockDir doesn't lock anything, on this system the operator must make sure that
+// commands which modify the data aren't run while the server is running.
+func lockDir(dir string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,111 @@
+// structured logging with request ids
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// logLevel can be changed while the server is running, when the config is reloaded.
+var logLevel = new(slog.LevelVar)
+
+// contextHandler adds the request id, the signed in user and the api token from the context to the records.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := middleware.GetReqID(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if _, session := GetSessionCtx(ctx); session.Data.Authenticated {
+			r.AddAttrs(slog.String("user", session.Data.Username))
+		}
+		if token, ok := GetTokenCtx(ctx); ok {
+			r.AddAttrs(slog.String("token", token.Id))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+func checkLogFormat(format string) error {
+	if format != "text" && format != "json" {
+		return errors.New("log.format must be \"text\" or \"json\"")
+	}
+	return nil
+}
+
+// SetupLogging sets the default logger, which is also used by the log package. The config must be validated.
+func SetupLogging(config LogConfig) {
+	level, _ := parseLogLevel(config.Level)
+	logLevel.Set(level)
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if config.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// RequestLogger logs every request once it's served and returns the request id in a header. It must be used after
+// middleware.RequestID and the session middleware, so that their values are logged too.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			w.Header().Set(middleware.RequestIDHeader, id)
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		remote := r.RemoteAddr
+		if i := strings.LastIndexByte(remote, ':'); i > 0 {
+			remote = remote[:i]
+		}
+		slog.Log(r.Context(), level, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+			"remote", remote,
+		)
+	})
+}
@@ -0,0 +1,62 @@
+// rendering notes from markdown to html
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+)
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM), // tables, task lists, strikethrough, autolinks
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+)
+
+// sanitizer is applied to the rendered html, so that it's safe to show notes to anyone,
+// even if goldmark lets something through.
+var sanitizer = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^[a-z0-9_-]+$`)).OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[a-zA-Z0-9_+-]+$`)).OnElements("code")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^(|checked|disabled)$`)).OnElements("input")
+	return p
+}()
+
+// replaceWikiLinks turns "[[target|label]]" into markdown links to the notes they point to.
+// Links which can't be resolved are replaced with their label.
+func replaceWikiLinks(content string, links []Link) string {
+	targets := make(map[string]string)
+	for _, l := range links {
+		targets[l.Text] = l.Target
+	}
+	return wikiLinkPattern.ReplaceAllStringFunc(content, func(s string) string {
+		m := wikiLinkPattern.FindStringSubmatch(s)
+		target := strings.TrimSpace(m[1])
+		label := target
+		if _, l, ok := strings.Cut(strings.Trim(s, "[]"), "|"); ok && strings.TrimSpace(l) != "" {
+			label = strings.TrimSpace(l)
+		}
+		label = strings.NewReplacer("[", "\\[", "]", "\\]").Replace(label)
+		if t := targets["[["+target+"]]"]; t != "" {
+			return fmt.Sprintf("[%s](/~%s)", label, t)
+		}
+		return label
+	})
+}
+
+// RenderMarkdown renders the note's content to sanitized html.
+func RenderMarkdown(content string, links []Link) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(replaceWikiLinks(content, links)), &buf); err != nil {
+		return nil, err
+	}
+	return sanitizer.SanitizeBytes(buf.Bytes()), nil
+}
@@ -0,0 +1,165 @@
+// prometheus metrics
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "senk_http_requests_total",
+		Help: "Number of HTTP requests, by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "senk_http_request_duration_seconds",
+		Help:    "Time spent serving HTTP requests, by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	storageWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "senk_storage_queue_wait_seconds",
+		Help:    "Time operations wait for the storage worker, by operation (read, write or task).",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"op"})
+	storageExec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "senk_storage_exec_seconds",
+		Help:    "Time the storage worker spends executing operations, by operation (read, write or task).",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"op"})
+
+	saveDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "senk_database_save_duration_seconds",
+		Help:    "Time spent saving the database.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	saveFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "senk_database_save_failures_total",
+		Help: "Number of failed database saves.",
+	})
+
+	signIns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "senk_signins_total",
+		Help: "Number of sign in attempts, by result (success or failure).",
+	}, []string{"result"})
+)
+
+func observeStorageWait(op string, queued time.Time) (start time.Time) {
+	start = time.Now()
+	if !queued.IsZero() {
+		storageWait.WithLabelValues(op).Observe(start.Sub(queued).Seconds())
+	}
+	return
+}
+
+func observeStorageExec(op string, start time.Time) {
+	storageExec.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// MetricsMiddleware counts the requests and measures their duration. Requests are labeled
+// with the matched route pattern rather than the path, so that the number of series is bounded.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// databaseCollector collects the metrics which are computed from the database when scraped.
+type databaseCollector struct {
+	db      *Database
+	backups *BackupSchedule
+
+	sessions    *prometheus.Desc
+	users       *prometheus.Desc
+	notes       *prometheus.Desc
+	storeSize   *prometheus.Desc
+	backupCount *prometheus.Desc
+	backupLast  *prometheus.Desc
+}
+
+func newDatabaseCollector(db *Database, backups *BackupSchedule) *databaseCollector {
+	return &databaseCollector{
+		db:          db,
+		backups:     backups,
+		sessions:    prometheus.NewDesc("senk_sessions_active", "Number of sessions which haven't expired.", []string{"authenticated"}, nil),
+		users:       prometheus.NewDesc("senk_users", "Number of users.", nil, nil),
+		notes:       prometheus.NewDesc("senk_notes", "Number of notes, by state (active or deleted).", []string{"state"}, nil),
+		storeSize:   prometheus.NewDesc("senk_store_size_bytes", "Size of the files in the user's store, including the history. The store \"_blobs\" holds attachments.", []string{"store"}, nil),
+		backupCount: prometheus.NewDesc("senk_backups_total", "Number of scheduled backups since the server started, by result (success or failure).", []string{"result"}, nil),
+		backupLast:  prometheus.NewDesc("senk_backup_last_success_timestamp_seconds", "Time of the last successful scheduled backup.", nil, nil),
+	}
+}
+
+func (c *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.sessions, c.users, c.notes, c.storeSize, c.backupCount, c.backupLast} {
+		ch <- d
+	}
+}
+
+func (c *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	authenticated, anonymous := c.db.Sessions.CountActive()
+	ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(authenticated), "true")
+	ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(anonymous), "false")
+
+	ch <- prometheus.MustNewConstMetric(c.users, prometheus.GaugeValue, float64(len(c.db.Users.GetAllUsernames())))
+
+	active, deleted := c.db.Metadata.CountNotes()
+	ch <- prometheus.MustNewConstMetric(c.notes, prometheus.GaugeValue, float64(active), "active")
+	ch <- prometheus.MustNewConstMetric(c.notes, prometheus.GaugeValue, float64(deleted), "deleted")
+
+	for store, size := range c.db.StoreSizes() {
+		ch <- prometheus.MustNewConstMetric(c.storeSize, prometheus.GaugeValue, float64(size), store)
+	}
+
+	if c.backups != nil {
+		stats := c.backups.Stats()
+		ch <- prometheus.MustNewConstMetric(c.backupCount, prometheus.CounterValue, float64(stats.Successes), "success")
+		ch <- prometheus.MustNewConstMetric(c.backupCount, prometheus.CounterValue, float64(stats.Failures), "failure")
+		if !stats.LastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.backupLast, prometheus.GaugeValue, float64(stats.LastSuccess.Unix()))
+		}
+	}
+}
+
+// MetricsHandler serves the metrics. If the token isn't empty, requests must have it as the bearer token.
+func MetricsHandler(db *Database, backups *BackupSchedule, token string) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration,
+		storageWait, storageExec,
+		saveDuration, saveFailures,
+		signIns,
+		newDatabaseCollector(db, backups),
+	)
+	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !hasBearerToken(r, token) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -1,25 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 var (
 	ErrNoAccess = errors.New("user does not have the required permission")
 	ErrIdUsed   = errors.New("note with this id exists")
+	ErrNotTrash = errors.New("note is not in the trash")
+
+	ErrNoUniqueId = errors.New("couldn't assign unique note id")
 )
 
 type PermissionLevel int
 
 const (
-	PermissionNone PermissionLevel = iota
+	PermissionInherit PermissionLevel = iota - 1 // use the permission of the parent folder
+	PermissionNone
 	PermissionRead
 	PermissionWrite
 )
@@ -30,6 +38,8 @@ func (p PermissionLevel) MarshalJSON() ([]byte, error) {
 		return json.Marshal("r")
 	case PermissionWrite:
 		return json.Marshal("w")
+	case PermissionInherit:
+		return json.Marshal("i")
 	default:
 		return json.Marshal("0")
 	}
@@ -47,6 +57,8 @@ func (p *PermissionLevel) UnmarshalJSON(data []byte) error {
 		*p = PermissionRead
 	case "w":
 		*p = PermissionWrite
+	case "i":
+		*p = PermissionInherit
 	}
 	return nil
 }
@@ -61,31 +73,76 @@ func (p *PermissionLevel) Limit(l PermissionLevel) PermissionLevel {
 
 type NoteMeta struct {
 	Owner        string
+	Title        string // parsed from the content
+	Folder       string // id of the parent folder, empty if the note is not in a folder
 	Public       PermissionLevel
-	Creation     time.Time // TODO: Show in client
+	Shares       map[string]PermissionLevel // permissions of specific users, indexed by the username
+	Creation     time.Time                  // TODO: Show in client
 	Modification time.Time
 	Access       time.Time
 	Deleted      bool
-	// TODO: Sharing
+	Tags         []string              // set explicitly
+	Hashtags     []string              // parsed from the content
+	Links        []Link                // parsed from the content
+	Attachments  map[string]Attachment // indexed by the file name
 }
 
-func (n *NoteMeta) GetPermissions(user string) PermissionLevel {
+// GetPermissions returns the user's permission level for the note. Public permission and shares
+// which are not set on the note are inherited from the folders it is in. The folders are indexed
+// like in Metadata.Folders.
+func (n *NoteMeta) GetPermissions(user string, folders map[string]FolderMeta) PermissionLevel {
 	if user == n.Owner {
 		return PermissionWrite
-	} else {
-		return n.Public.Limit(PermissionRead)
 	}
+
+	public := n.Public
+	share, shared := n.Shares[user]
+	folder := n.Folder
+	for depth := 0; (public == PermissionInherit || !shared) && folder != "" && depth < MaxFolderDepth; depth++ {
+		f, ok := folders[fmt.Sprintf("%s/%s", n.Owner, folder)]
+		if !ok {
+			break
+		}
+		if public == PermissionInherit {
+			public = f.Public
+		}
+		if !shared {
+			share, shared = f.Shares[user]
+		}
+		folder = f.Parent
+	}
+
+	p := public.Limit(PermissionRead)
+	if p < PermissionNone {
+		p = PermissionNone
+	}
+	if shared && user != "" && share > p {
+		p = share
+	}
+	return p
 }
 
 type Metadata struct {
-	Notes map[string]NoteMeta
-	mu    sync.RWMutex
+	Notes   map[string]NoteMeta
+	Folders map[string]FolderMeta
+	titles  map[string][]string // paths of the notes by owner and title, see notesWithTitle
+	mu      sync.RWMutex
 }
 
 func (m *Metadata) Initialize() {
 	if m.Notes == nil {
 		m.Notes = make(map[string]NoteMeta)
 	}
+	if m.Folders == nil {
+		m.Folders = make(map[string]FolderMeta)
+	}
+}
+
+// GetPermissions returns the user's permission level for the note.
+func (m *Metadata) GetPermissions(n *NoteMeta, user string) PermissionLevel {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return n.GetPermissions(user, m.Folders)
 }
 
 func (m *Metadata) GetNoteMeta(user, id string) NoteMeta {
@@ -116,6 +173,17 @@ func (m *Metadata) BumpNoteTimers(user, id string, write bool) {
 	m.Notes[key] = meta
 }
 
+// SetNoteTimes sets the creation and modification time of the note, for example when it is imported.
+func (m *Metadata) SetNoteTimes(user, id string, created, modified time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta := m.Notes[key]
+	meta.Creation = created
+	meta.Modification = modified
+	m.Notes[key] = meta
+}
+
 func (m *Metadata) SetDeleted(user, id string, deleted bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -136,6 +204,40 @@ type Note struct {
 	Metadata NoteMeta
 }
 
+// CountNotes returns the number of notes of all users.
+func (m *Metadata) CountNotes() (active, deleted int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, n := range m.Notes {
+		if n.Deleted {
+			deleted++
+		} else {
+			active++
+		}
+	}
+	return
+}
+
+// UserUsage returns the numbers of the user's notes and of the ones in the trash, and the total size of their attachments.
+func (m *Metadata) UserUsage(user string) (active, deleted int, attachments int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, n := range m.Notes {
+		if b, _, _ := strings.Cut(k, "/"); b != user {
+			continue
+		}
+		if n.Deleted {
+			deleted++
+		} else {
+			active++
+		}
+		for _, a := range n.Attachments {
+			attachments += a.Size
+		}
+	}
+	return
+}
+
 func (m *Metadata) GetUserNotes(user string) []Note {
 	// TODO: Maybe make this more efficient
 	notes := make([]Note, 0)
@@ -173,12 +275,18 @@ type NoteWrite struct {
 	id      string // note id
 	create  bool   // abort if note already exists
 	delete  bool   // note is to be deleted if true (content is ignored)
+	restore bool   // note is to be restored from the trash if true (content is ignored)
 	content string
+	ctx     context.Context // context of the request, for logging
+	queued  time.Time       // when the write was sent to the storage worker
 	resp    chan error
 }
 
 func (w *NoteWrite) Execute(db *Database) error {
-	s := db.storage.UserStores[w.user]
+	s, ok := db.storage.UserStores[w.owner]
+	if !ok {
+		return ErrNoAccess // the owner was deleted
+	}
 
 	if w.create {
 		_, err := s.Stat(w.id, false)
@@ -187,6 +295,8 @@ func (w *NoteWrite) Execute(db *Database) error {
 		}
 	} else if !db.Metadata.CheckPermission(w.owner, w.id, w.user, PermissionWrite) {
 		return ErrNoAccess
+	} else if w.restore && !db.Metadata.IsDeleted(w.owner, w.id) {
+		return ErrNotTrash
 	}
 
 	db.Metadata.BumpNoteTimers(w.owner, w.id, true)
@@ -195,30 +305,86 @@ func (w *NoteWrite) Execute(db *Database) error {
 		db.Metadata.SetDeleted(w.owner, w.id, true)
 		return nil
 	}
+	if w.restore {
+		db.Metadata.SetDeleted(w.owner, w.id, false)
+		return nil
+	}
 
 	f, err := s.Overwrite(w.id)
 	if err != nil {
 		return err
 	}
-	db.storage.UserStores[w.user] = s
+	db.storage.UserStores[w.owner] = s
 	_, err = f.WriteString(w.content)
 	if err != nil {
 		return err
 	}
 
+	db.Metadata.SetHashtags(w.owner, w.id, ParseHashtags(w.content))
+	db.Metadata.SetContentLinks(w.owner, w.id, ParseTitle(w.content), ParseLinks(w.content))
+
 	return nil
 }
 
+// NewNote creates an empty note in the folder (which must exist, unless it is empty) and returns its id.
+func (db *Database) NewNote(ctx context.Context, user, folder string) (string, error) {
+	var id string
+	for i := 0; i < 10; i++ { // Retry in case of id collision, at most 10 times
+		id = uuid.NewString()
+
+		respc := make(chan error)
+		db.storage.Writes <- NoteWrite{
+			user:    user,
+			owner:   user,
+			id:      id,
+			create:  true,
+			delete:  false,
+			content: "",
+			ctx:     ctx,
+			queued:  db.storage.enqueue(),
+			resp:    respc,
+		}
+
+		err := <-respc
+
+		if errors.Is(err, ErrIdUsed) {
+			slog.WarnContext(ctx, "Note ID collision", "owner", user, "id", id)
+			id = ""
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if id == "" {
+		return "", ErrNoUniqueId
+	}
+
+	now := time.Now()
+	db.Metadata.SetNoteMeta(user, id, NoteMeta{
+		Owner:        user,
+		Folder:       folder,
+		Public:       PermissionInherit,
+		Creation:     now,
+		Modification: now,
+		Access:       now,
+	})
+	return id, nil
+}
+
 type NoteReadResp struct {
 	v   string
 	err error
 }
 
 type NoteRead struct {
-	user      string // user performing the action
-	owner     string // note owner
-	id        string // note id
-	fromTrash bool   // read from trash
+	user      string          // user performing the action
+	owner     string          // note owner
+	id        string          // note id
+	fromTrash bool            // read from trash
+	ctx       context.Context // context of the request, for logging
+	queued    time.Time       // when the read was sent to the storage worker
 	resp      chan NoteReadResp
 }
 
@@ -231,7 +397,7 @@ func (r *NoteRead) Execute(db *Database) (string, error) {
 		db.Metadata.BumpNoteTimers(r.user, r.id, false)
 	}
 
-	s := db.storage.UserStores[r.user]
+	s := db.storage.UserStores[r.owner]
 
 	f, err := s.Open(r.id, 0)
 	if err != nil {
@@ -249,6 +415,8 @@ func (r *NoteRead) Execute(db *Database) (string, error) {
 // CheckPermission returns true if the accessor has the permission
 // to perform the operation to the user's note with the given slug.
 func (m *Metadata) CheckPermission(owner, slug, accessor string, operation PermissionLevel) bool {
-	n := m.GetNoteMeta(owner, slug)
-	return n.GetPermissions(accessor) >= operation
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := m.Notes[fmt.Sprintf("%s/%s", owner, slug)]
+	return n.GetPermissions(accessor, m.Folders) >= operation
 }
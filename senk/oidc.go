@@ -0,0 +1,349 @@
+// signing in with an openid connect identity provider
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcStateCookie binds the authorization request to the browser which started it.
+const oidcStateCookie = "oidc_state"
+
+// oidcFlowTimeout limits the time the user has to sign in with the identity provider.
+const oidcFlowTimeout = 10 * time.Minute
+
+// oidcMaxFlows limits the number of unfinished sign ins, which anyone can start.
+const oidcMaxFlows = 1000
+
+var (
+	ErrOIDCUsername  = errors.New("the identity provider didn't return a valid username")
+	ErrOIDCBusy      = errors.New("too many sign ins in progress, try again later")
+	ErrOIDCNoAccount = errors.New("there is no account for this user")
+	ErrOIDCNotLinked = errors.New("an account with this username exists, but it isn't linked to this identity, ask an administrator to link it")
+	ErrOIDCLinked    = errors.New("the identity is already linked to another user")
+	ErrOIDCDisabled  = errors.New("signing in with an identity provider isn't configured")
+)
+
+// OIDCIdentity is a user at an identity provider. Unlike the username claim, the subject
+// is assigned by the provider and never changes.
+type OIDCIdentity struct {
+	Issuer  string
+	Subject string
+}
+
+// oidcFlow is an authorization request which is waiting for the callback.
+type oidcFlow struct {
+	verifier string // PKCE code verifier
+	nonce    string
+	redirect string // where to go after signing in
+	started  time.Time
+}
+
+// OIDC signs users in with the authorization code flow with PKCE. The provider's metadata is
+// discovered on the first sign in, so that the server can start while the provider is unavailable.
+// Its signing keys are cached and fetched again when a token is signed with an unknown key.
+type OIDC struct {
+	config OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	flows    map[string]oidcFlow // indexed by the state
+}
+
+// NewOIDC returns nil if signing in with an identity provider isn't configured.
+func NewOIDC(config OIDCConfig) *OIDC {
+	if !config.Enabled() {
+		return nil
+	}
+	return &OIDC{config: config, flows: make(map[string]oidcFlow)}
+}
+
+// discover returns the OAuth2 configuration and the ID token verifier, fetching the provider's metadata if needed.
+func (o *OIDC) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider == nil {
+		// The provider keeps the context for fetching the keys later, so it must not be the request's one.
+		provider, err := oidc.NewProvider(context.WithoutCancel(ctx), o.config.Issuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("discovering the identity provider: %w", err)
+		}
+		o.provider = provider
+		o.verifier = provider.Verifier(&oidc.Config{ClientID: o.config.ClientID})
+	}
+	return &oauth2.Config{
+		ClientID:     o.config.ClientID,
+		ClientSecret: o.config.ClientSecret,
+		RedirectURL:  o.config.RedirectURL,
+		Endpoint:     o.provider.Endpoint(),
+		Scopes:       strings.Fields(o.config.Scopes),
+	}, o.verifier, nil
+}
+
+// startFlow remembers a new authorization request and returns its state.
+func (o *OIDC) startFlow(flow oidcFlow) (string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for s, f := range o.flows {
+		if time.Since(f.started) >= oidcFlowTimeout {
+			delete(o.flows, s)
+		}
+	}
+	if len(o.flows) >= oidcMaxFlows {
+		return "", ErrOIDCBusy
+	}
+	o.flows[state] = flow
+	return state, nil
+}
+
+// finishFlow returns and forgets the authorization request with the state.
+func (o *OIDC) finishFlow(state string) (oidcFlow, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	flow, ok := o.flows[state]
+	delete(o.flows, state)
+	if !ok || time.Since(flow.started) >= oidcFlowTimeout {
+		return oidcFlow{}, false
+	}
+	return flow, true
+}
+
+// username returns the username from the configured claim of the ID token.
+func (o *OIDC) username(token *oidc.IDToken) (string, error) {
+	var claims map[string]any
+	if err := token.Claims(&claims); err != nil {
+		return "", err
+	}
+	username, ok := claims[o.config.UsernameClaim].(string)
+	if !ok {
+		return "", ErrOIDCUsername
+	}
+	username = strings.ToLower(username)
+	if _, err := NewUser(username); err != nil {
+		return "", ErrOIDCUsername
+	}
+	return username, nil
+}
+
+// FindOIDCUser returns the user linked to the identity.
+func (users *Users) FindOIDCUser(identity OIDCIdentity) (User, error) {
+	users.mu.RLock()
+	defer users.mu.RUnlock()
+	for _, u := range users.List {
+		if u.OIDC != nil && *u.OIDC == identity {
+			return u, nil
+		}
+	}
+	return User{}, ErrNotExist
+}
+
+// LinkOIDC links the user to the identity, so that they can sign in with it. A nil identity removes the link.
+func (users *Users) LinkOIDC(username string, identity *OIDCIdentity) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	i := users.index(username)
+	if i == -1 {
+		return ErrNotExist
+	}
+	if identity != nil {
+		for _, u := range users.List {
+			if u.OIDC != nil && *u.OIDC == *identity && u.Username != username {
+				return ErrOIDCLinked
+			}
+		}
+	}
+	users.List[i].OIDC = identity
+	slog.Info("Identity provider link set", "username", username, "identity", identity)
+	return nil
+}
+
+// oidcUser returns the user linked to the token's identity. If there is none, and creating users is enabled,
+// a new user named by the username claim is created and linked. Existing users are never linked when signing in,
+// because whoever can choose the claim at the provider could then sign in as them.
+func (db *Database) oidcUser(ctx context.Context, o *OIDC, token *oidc.IDToken) (User, error) {
+	identity := OIDCIdentity{Issuer: token.Issuer, Subject: token.Subject}
+	if user, err := db.Users.FindOIDCUser(identity); !errors.Is(err, ErrNotExist) {
+		return user, err
+	}
+
+	username, err := o.username(token)
+	if err != nil {
+		return User{}, err
+	}
+	// The username is returned with the errors, for recording them.
+	if _, err := db.Users.GetUser(username); err == nil {
+		return User{Username: username}, ErrOIDCNotLinked
+	}
+	if !o.config.CreateUsers {
+		return User{Username: username}, ErrOIDCNoAccount
+	}
+	if err := db.ProvisionUser(username); errors.Is(err, ErrExist) {
+		return User{Username: username}, ErrOIDCNotLinked // created meanwhile
+	} else if err != nil {
+		return User{Username: username}, err
+	}
+	if err := db.Users.LinkOIDC(username, &identity); err != nil {
+		return User{}, err
+	}
+	db.audit(ctx, AuditEntry{Action: AuditUserCreate, Actor: username, Target: username, Detail: "oidc"})
+	return db.Users.GetUser(username)
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oidcSignIn redirects to the identity provider. After signing in, the user returns to the page in the
+// "redirect" query parameter, which must be a path on this server.
+func (db *Database) oidcSignIn(o *OIDC) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, _, err := o.discover(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error signing in with the identity provider", "err", err)
+			http.Error(w, "The identity provider is unavailable", http.StatusBadGateway)
+			return
+		}
+
+		flow := oidcFlow{
+			verifier: oauth2.GenerateVerifier(),
+			redirect: localRedirect(r, r.URL.Query().Get("redirect")),
+			started:  time.Now(),
+		}
+		if flow.nonce, err = randomString(); err != nil {
+			http.Error(w, "Undefined error", http.StatusInternalServerError)
+			return
+		}
+		state, err := o.startFlow(flow)
+		if errors.Is(err, ErrOIDCBusy) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, "Undefined error", http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/session/oidc",
+			Secure:   secureCookies(r),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode, // sent with the redirect back from the provider
+			MaxAge:   int(oidcFlowTimeout.Seconds()),
+		})
+		http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(flow.nonce), oauth2.S256ChallengeOption(flow.verifier)), http.StatusFound)
+	}
+}
+
+// oidcCallback exchanges the authorization code for the ID token, validates it and signs the user in.
+func (db *Database) oidcCallback(o *OIDC) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			slog.InfoContext(r.Context(), "Identity provider returned an error", "error", e, "description", query.Get("error_description"))
+			http.Error(w, "Signing in with the identity provider failed", http.StatusForbidden)
+			return
+		}
+
+		cookie, err := r.Cookie(oidcStateCookie)
+		state := query.Get("state")
+		if err != nil || state == "" || cookie.Value != state {
+			http.Error(w, "Invalid sign in state, try again", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/session/oidc", MaxAge: -1})
+		flow, ok := o.finishFlow(state)
+		if !ok {
+			http.Error(w, "Sign in expired, try again", http.StatusBadRequest)
+			return
+		}
+
+		config, verifier, err := o.discover(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error signing in with the identity provider", "err", err)
+			http.Error(w, "The identity provider is unavailable", http.StatusBadGateway)
+			return
+		}
+		token, err := config.Exchange(r.Context(), query.Get("code"), oauth2.VerifierOption(flow.verifier))
+		if err != nil {
+			slog.WarnContext(r.Context(), "Error exchanging the authorization code", "err", err)
+			http.Error(w, "Signing in with the identity provider failed", http.StatusForbidden)
+			return
+		}
+		raw, ok := token.Extra("id_token").(string)
+		if !ok {
+			slog.WarnContext(r.Context(), "Identity provider didn't return an ID token")
+			http.Error(w, "Signing in with the identity provider failed", http.StatusForbidden)
+			return
+		}
+		idToken, err := verifier.Verify(r.Context(), raw)
+		if err == nil && idToken.Nonce != flow.nonce {
+			err = errors.New("nonce doesn't match")
+		}
+		if err != nil {
+			slog.WarnContext(r.Context(), "Invalid ID token", "err", err)
+			signIns.WithLabelValues("failure").Inc()
+			http.Error(w, "Signing in with the identity provider failed", http.StatusForbidden)
+			return
+		}
+
+		user, err := db.oidcUser(r.Context(), o, idToken)
+		switch {
+		case err == nil && user.Disabled:
+			err = ErrDisabled
+		case errors.Is(err, ErrOIDCUsername):
+			slog.WarnContext(r.Context(), "Invalid username claim", "claim", o.config.UsernameClaim, "subject", idToken.Subject)
+		case errors.Is(err, ErrOIDCNotLinked), errors.Is(err, ErrOIDCNoAccount), errors.Is(err, ErrDeleted):
+		case err != nil:
+			slog.ErrorContext(r.Context(), "Error signing in with the identity provider", "subject", idToken.Subject, "err", err)
+			http.Error(w, "Undefined error", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			signIns.WithLabelValues("failure").Inc()
+			// The subject is recorded, so that an administrator can link the account to it.
+			db.audit(r.Context(), AuditEntry{Action: AuditSignInFailed, Target: user.Username, Detail: "oidc " + idToken.Subject})
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if user.TOTP != nil && user.TOTP.Enabled {
+			// Like after the password, the session is only authenticated once the second factor is verified.
+			if !db.startSession(w, r, SessionData{Username: user.Username, Pending: true, Redirect: flow.redirect}) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/session/2fa", http.StatusFound)
+			return
+		}
+		signIns.WithLabelValues("success").Inc()
+		db.audit(r.Context(), AuditEntry{Action: AuditSignIn, Actor: user.Username, Target: user.Username, Detail: "oidc"})
+		if !db.startSession(w, r, SessionData{Authenticated: true, Username: user.Username}) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Signed in with the identity provider", "username", user.Username, "subject", idToken.Subject)
+		http.Redirect(w, r, flow.redirect, http.StatusFound)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP is an identity provider which issues ID tokens for codes registered by the test.
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu    sync.Mutex
+	key   *rsa.PrivateKey
+	kid   string
+	codes map[string]mockGrant
+}
+
+// mockGrant is an authorization code, bound to the PKCE challenge of the request it was issued for.
+type mockGrant struct {
+	challenge string
+	claims    map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{t: t, codes: make(map[string]mockGrant)}
+	idp.rotate("key1")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.server.URL,
+			"authorization_endpoint":                idp.server.URL + "/authorize",
+			"token_endpoint":                        idp.server.URL + "/token",
+			"jwks_uri":                              idp.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": idp.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		grant, ok := idp.codes[r.PostFormValue("code")]
+		delete(idp.codes, r.PostFormValue("code"))
+		idp.mu.Unlock()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   60,
+			"id_token":     idp.sign(grant.claims),
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// rotate replaces the signing key, the old one is no longer published.
+func (idp *mockIdP) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.key, idp.kid = key, kid
+}
+
+// sign returns a JWT with the claims, signed with RS256.
+func (idp *mockIdP) sign(claims map[string]any) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": idp.kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// grant registers a code for the authorization request, with an ID token for the subject and the username claim.
+// The nonce and the PKCE challenge are taken from the authorization request.
+func (idp *mockIdP) grant(auth *url.URL, subject, username string) string {
+	query := auth.Query()
+	code := subject + "-" + query.Get("state")[:8]
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.codes[code] = mockGrant{challenge: query.Get("code_challenge"), claims: map[string]any{
+		"iss":                idp.server.URL,
+		"sub":                subject,
+		"aud":                "senk",
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              query.Get("nonce"),
+		"preferred_username": username,
+	}}
+	return code
+}
+
+// oidcTest is a server with an identity provider.
+type oidcTest struct {
+	t   *testing.T
+	db  *Database
+	o   *OIDC
+	idp *mockIdP
+}
+
+func newOIDCTest(t *testing.T, createUsers bool) *oidcTest {
+	idp := newMockIdP(t)
+	config := DefaultConfig()
+	config.OIDC.Issuer = idp.server.URL
+	config.OIDC.ClientID = "senk"
+	config.OIDC.ClientSecret = "secret"
+	config.OIDC.RedirectURL = "http://senk.test/session/oidc/callback"
+	config.OIDC.CreateUsers = createUsers
+	SetConfig(config)
+	t.Cleanup(func() { SetConfig(nil) })
+
+	db := &Database{storage: InitStorage(t.TempDir())}
+	db.Sessions.Initialize()
+	db.StartStorageWorker()
+	return &oidcTest{t: t, db: db, o: NewOIDC(config.OIDC), idp: idp}
+}
+
+// start begins signing in and returns the authorization URL and the state cookie.
+func (test *oidcTest) start() (*url.URL, *http.Cookie) {
+	w := httptest.NewRecorder()
+	test.db.oidcSignIn(test.o)(w, httptest.NewRequest(http.MethodGet, "/session/oidc?redirect=/~alice/n1", nil))
+	if w.Code != http.StatusFound {
+		test.t.Fatalf("starting to sign in: status %d: %s", w.Code, w.Body)
+	}
+	auth, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		test.t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			return auth, c
+		}
+	}
+	test.t.Fatal("no state cookie")
+	return nil, nil
+}
+
+// callback returns from the identity provider with the code and the state.
+func (test *oidcTest) callback(cookie *http.Cookie, state, code string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/session/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	test.db.oidcCallback(test.o)(w, r)
+	return w
+}
+
+// signIn signs in as the subject and returns the response of the callback.
+func (test *oidcTest) signIn(subject, username string) *httptest.ResponseRecorder {
+	auth, cookie := test.start()
+	return test.callback(cookie, auth.Query().Get("state"), test.idp.grant(auth, subject, username))
+}
+
+// session returns the session started by the response.
+func (test *oidcTest) session(w *httptest.ResponseRecorder) SessionData {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookieName {
+			return test.db.Sessions.Map[c.Value].Data
+		}
+	}
+	test.t.Fatalf("no session started: status %d: %s", w.Code, w.Body)
+	return SessionData{}
+}
+
+func TestOIDCAuthorizationRequest(t *testing.T) {
+	test := newOIDCTest(t, false)
+	auth, cookie := test.start()
+	query := auth.Query()
+	if !strings.HasPrefix(auth.String(), test.idp.server.URL+"/authorize?") {
+		t.Errorf("redirected to %s", auth)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Errorf("no PKCE challenge: %s", auth)
+	}
+	if query.Get("nonce") == "" || query.Get("state") != cookie.Value {
+		t.Errorf("no nonce or state doesn't match the cookie: %s", auth)
+	}
+}
+
+func TestOIDCCreateUser(t *testing.T) {
+	test := newOIDCTest(t, true)
+	w := test.signIn("subject-carol", "Carol")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/~alice/n1" {
+		t.Fatalf("got status %d to %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if s := test.session(w); !s.Authenticated || s.Username != "carol" {
+		t.Errorf("session: %+v", s)
+	}
+	user, err := test.db.Users.GetUser("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (OIDCIdentity{Issuer: test.idp.server.URL, Subject: "subject-carol"}); user.OIDC == nil || *user.OIDC != want {
+		t.Errorf("identity: got %v, want %v", user.OIDC, want)
+	}
+	if user.PasswordHash != "" {
+		t.Error("created user has a password")
+	}
+
+	// the subject decides the user, not the claim, which the user may be able to change
+	w = test.signIn("subject-carol", "dave")
+	if s := test.session(w); s.Username != "carol" {
+		t.Errorf("changed claim: signed in as %q", s.Username)
+	}
+	if _, err := test.db.Users.GetUser("dave"); err == nil {
+		t.Error("changed claim created a user")
+	}
+	// another subject with the same claim doesn't get the account
+	if w := test.signIn("subject-mallory", "carol"); w.Code != http.StatusForbidden {
+		t.Errorf("other subject with the claim: got status %d", w.Code)
+	}
+}
+
+func TestOIDCNoAccount(t *testing.T) {
+	test := newOIDCTest(t, false)
+	if w := test.signIn("subject-carol", "carol"); w.Code != http.StatusForbidden {
+		t.Errorf("got status %d", w.Code)
+	}
+	if _, err := test.db.Users.GetUser("carol"); err == nil {
+		t.Error("user was created")
+	}
+}
+
+func TestOIDCExistingUser(t *testing.T) {
+	test := newOIDCTest(t, true)
+	if err := test.db.Users.AddUser("alice", "correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an account with a password is never linked by signing in
+	if w := test.signIn("subject-alice", "alice"); w.Code != http.StatusForbidden {
+		t.Fatalf("unlinked account: got status %d", w.Code)
+	}
+	if user, _ := test.db.Users.GetUser("alice"); user.OIDC != nil {
+		t.Fatalf("account was linked: %v", user.OIDC)
+	}
+
+	// after an administrator links it, it can sign in
+	if err := test.db.Users.LinkOIDC("alice", &OIDCIdentity{Issuer: test.idp.server.URL, Subject: "subject-alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := test.db.Users.LinkOIDC("bob", &OIDCIdentity{Issuer: test.idp.server.URL, Subject: "subject-alice"}); err == nil {
+		t.Error("linked a missing user")
+	}
+	if s := test.session(test.signIn("subject-alice", "alice")); !s.Authenticated || s.Username != "alice" {
+		t.Errorf("linked account: %+v", s)
+	}
+
+	// the second factor is still required
+	key, err := newTOTPKey("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.db.Users.List[0].TOTP = &TOTP{Secret: key.Secret(), Enabled: true}
+	w := test.signIn("subject-alice", "alice")
+	if w.Header().Get("Location") != "/session/2fa" {
+		t.Errorf("with 2FA: redirected to %q", w.Header().Get("Location"))
+	}
+	if s := test.session(w); s.Authenticated || !s.Pending || s.Redirect != "/~alice/n1" {
+		t.Errorf("with 2FA: %+v", s)
+	}
+
+	// disabled users can't sign in
+	if err := test.db.Users.SetDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if w := test.signIn("subject-alice", "alice"); w.Code != http.StatusForbidden {
+		t.Errorf("disabled: got status %d", w.Code)
+	}
+}
+
+func TestOIDCStateMismatch(t *testing.T) {
+	test := newOIDCTest(t, true)
+	auth, cookie := test.start()
+	other, _ := test.start()
+	code := test.idp.grant(auth, "subject-carol", "carol")
+	if w := test.callback(cookie, other.Query().Get("state"), code); w.Code != http.StatusBadRequest {
+		t.Errorf("other state: got status %d", w.Code)
+	}
+	// the state can be used only once
+	if w := test.callback(cookie, auth.Query().Get("state"), code); w.Code != http.StatusFound {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	code = test.idp.grant(auth, "subject-carol", "carol")
+	if w := test.callback(cookie, auth.Query().Get("state"), code); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed state: got status %d", w.Code)
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	test := newOIDCTest(t, true)
+	auth, cookie := test.start()
+	other, _ := test.start()
+	// the token was issued for another authorization request, but with this request's PKCE challenge
+	query := auth.Query()
+	query.Set("nonce", other.Query().Get("nonce"))
+	forged := *auth
+	forged.RawQuery = query.Encode()
+	code := test.idp.grant(&forged, "subject-carol", "carol")
+	if w := test.callback(cookie, auth.Query().Get("state"), code); w.Code != http.StatusForbidden {
+		t.Errorf("got status %d", w.Code)
+	}
+	if _, err := test.db.Users.GetUser("carol"); err == nil {
+		t.Error("user was created")
+	}
+}
+
+func TestOIDCPKCE(t *testing.T) {
+	test := newOIDCTest(t, true)
+	auth, _ := test.start()
+	other, cookie := test.start()
+	// the code was issued for another authorization request, so the verifier doesn't match its challenge
+	query := other.Query()
+	query.Set("code_challenge", auth.Query().Get("code_challenge"))
+	forged := *other
+	forged.RawQuery = query.Encode()
+	code := test.idp.grant(&forged, "subject-carol", "carol")
+	if w := test.callback(cookie, other.Query().Get("state"), code); w.Code != http.StatusForbidden {
+		t.Errorf("got status %d", w.Code)
+	}
+	if _, err := test.db.Users.GetUser("carol"); err == nil {
+		t.Error("user was created")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	test := newOIDCTest(t, true)
+	if s := test.session(test.signIn("subject-carol", "carol")); !s.Authenticated {
+		t.Fatalf("first key: %+v", s)
+	}
+	// the keys are cached, a token signed with an unknown key makes the verifier fetch them again
+	test.idp.rotate("key2")
+	if s := test.session(test.signIn("subject-carol", "carol")); !s.Authenticated || s.Username != "carol" {
+		t.Errorf("rotated key: %+v", s)
+	}
+}
+
+func TestOIDCMaxFlows(t *testing.T) {
+	test := newOIDCTest(t, true)
+	for i := 0; i < oidcMaxFlows; i++ {
+		if _, err := test.o.startFlow(oidcFlow{started: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	test.db.oidcSignIn(test.o)(w, httptest.NewRequest(http.MethodGet, "/session/oidc", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d", w.Code)
+	}
+
+	// expired flows make room for new ones
+	test.o.mu.Lock()
+	for state, flow := range test.o.flows {
+		flow.started = flow.started.Add(-oidcFlowTimeout)
+		test.o.flows[state] = flow
+	}
+	test.o.mu.Unlock()
+	test.start()
+	if n := len(test.o.flows); n != 1 {
+		t.Errorf("%d flows after the expired ones were removed", n)
+	}
+}
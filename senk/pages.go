@@ -0,0 +1,282 @@
+// server-side rendered pages, usable without javascript
+
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type noteList struct {
+	Notes []Note
+	Trash bool
+	Side  bool
+}
+
+// initialData is embedded in the page, so that the script doesn't have to request it again.
+type initialData struct {
+	Path    string
+	Index   []Note  `json:",omitempty"`
+	Content *string `json:",omitempty"`
+}
+
+type page struct {
+	View     string // class of the body element: "index-view", "note-view", "trashnote-view", "account-view" or "admin-view"
+	Title    string
+	Heading  string // shown in the toolbar if the page isn't a note
+	Username string // signed in user
+	Owner    string
+	Id       string
+	Error    string
+	Index    *noteList
+	Side     *noteList
+	Editable bool
+	Content  string
+	Rendered template.HTML
+	Account  *accountData
+	Admin    *adminData
+	Initial  initialData
+}
+
+func (p *page) render(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, "app.html", p); err != nil {
+		slog.Error("Error executing page template", "err", err)
+	}
+}
+
+// newPage returns a page with the data common for all views filled in.
+func newPage(r *http.Request, view string) page {
+	_, session := GetSessionCtx(r.Context())
+	p := page{View: view, Initial: initialData{Path: r.URL.Path}}
+	if session.Data.Authenticated {
+		p.Username = session.Data.Username
+	}
+	return p
+}
+
+// readContent reads the note through the storage worker.
+func (db *Database) readContent(ctx context.Context, user, owner, id string, fromTrash bool) (string, error) {
+	respc := make(chan NoteReadResp)
+	db.storage.Reads <- NoteRead{
+		user:      user,
+		owner:     owner,
+		id:        id,
+		fromTrash: fromTrash,
+		ctx:       ctx,
+		queued:    db.storage.enqueue(),
+		resp:      respc,
+	}
+	resp := <-respc
+	return resp.v, resp.err
+}
+
+// serveIndexPage serves the index of the user given in the optional chi URL param "user".
+// Without the param, it serves the index of the signed in user or the sign in page.
+func (db *Database) serveIndexPage(w http.ResponseWriter, r *http.Request) {
+	p := newPage(r, "index-view")
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	if user == "" {
+		if p.Username == "" {
+			serveLogin(w, r)
+			return
+		}
+		user = p.Username
+	} else {
+		p.Owner = user
+		p.Title = "~" + user
+	}
+
+	notes, err := db.indexNotes(user, p.Username, r.URL.Query())
+	if err != nil {
+		p.Error = err.Error()
+		p.render(w, http.StatusBadRequest)
+		return
+	}
+	p.Index = &noteList{Notes: notes}
+	p.Initial.Index = notes
+	p.render(w, http.StatusOK)
+}
+
+func (db *Database) serveTrashPage(w http.ResponseWriter, r *http.Request) {
+	p := newPage(r, "index-view")
+	if p.Username == "" {
+		serveLogin(w, r)
+		return
+	}
+	p.Title = "Trash"
+	p.Heading = "Trash"
+
+	notes := db.Metadata.GetUserTrash(p.Username)
+	p.Index = &noteList{Notes: notes, Trash: true}
+	p.Initial.Index = notes
+	p.render(w, http.StatusOK)
+}
+
+// serveNotePage serves the editor if the user can write to the note, or the rendered note otherwise.
+// If fromTrash is true, the note is read from the trash and is never editable.
+// expects following chi URL params: user, id
+func (db *Database) serveNotePage(fromTrash bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := newPage(r, "note-view")
+		if fromTrash {
+			p.View = "trashnote-view"
+		}
+		p.Owner = strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+		p.Id = chi.URLParam(r, "id")
+
+		content, err := db.readContent(r.Context(), p.Username, p.Owner, p.Id, fromTrash)
+		if errors.Is(err, os.ErrNotExist) {
+			p.Error = "Note not found"
+			p.render(w, http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrNoAccess) {
+			if p.Username == "" {
+				serveLogin(w, r)
+				return
+			}
+			p.Error = "Insufficient permissions"
+			p.render(w, http.StatusForbidden)
+			return
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "Error serving note page", "err", err)
+			p.Error = "Undefined error"
+			p.render(w, http.StatusInternalServerError)
+			return
+		}
+
+		meta := db.Metadata.GetNoteMeta(p.Owner, p.Id)
+		p.Title = meta.Title
+		p.Content = content
+		p.Initial.Content = &content
+		p.Editable = !fromTrash && p.Username != "" && db.Metadata.GetPermissions(&meta, p.Username) >= PermissionWrite
+		if p.Username != "" {
+			notes, _ := db.indexNotes(p.Username, p.Username, nil)
+			p.Side = &noteList{Notes: notes, Side: true}
+		}
+		if !p.Editable {
+			rendered, err := RenderMarkdown(content, meta.Links)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error rendering note", "owner", p.Owner, "id", p.Id, "err", err)
+			}
+			p.Rendered = template.HTML(rendered)
+		}
+		p.render(w, http.StatusOK)
+	}
+}
+
+// saveNoteForm saves the note from the "content" form value and redirects back to the note.
+// expects following chi URL params: user, id
+func (db *Database) saveNoteForm(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can edit notes", http.StatusForbidden)
+		return
+	}
+
+	respc := make(chan error)
+	db.storage.Writes <- NoteWrite{
+		user:    session.Data.Username,
+		owner:   user,
+		id:      note,
+		content: strings.ReplaceAll(r.PostFormValue("content"), "\r\n", "\n"),
+		ctx:     r.Context(),
+		queued:  db.storage.enqueue(),
+		resp:    respc,
+	}
+
+	err := <-respc
+	if errors.Is(err, ErrNoAccess) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error serving note form write request", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, "/~"+user+"/"+note, http.StatusSeeOther)
+}
+
+// deleteNoteForm moves the note to the trash and redirects to it.
+// expects following chi URL params: user, id
+func (db *Database) deleteNoteForm(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can delete notes", http.StatusForbidden)
+		return
+	}
+
+	respc := make(chan error)
+	db.storage.Writes <- NoteWrite{
+		user:   session.Data.Username,
+		owner:  user,
+		id:     note,
+		delete: true,
+		ctx:    r.Context(),
+		queued: db.storage.enqueue(),
+		resp:   respc,
+	}
+
+	err := <-respc
+	if errors.Is(err, ErrNoAccess) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error serving note form delete request", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// restoreNoteForm moves the note out of the trash and redirects to it.
+// expects following chi URL params: user, id
+func (db *Database) restoreNoteForm(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimPrefix(chi.URLParam(r, "user"), "~")
+	note := chi.URLParam(r, "id")
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Authenticated {
+		http.Error(w, "Only authenticated users can restore notes", http.StatusForbidden)
+		return
+	}
+
+	respc := make(chan error)
+	db.storage.Writes <- NoteWrite{
+		user:    session.Data.Username,
+		owner:   user,
+		id:      note,
+		restore: true,
+		ctx:     r.Context(),
+		queued:  db.storage.enqueue(),
+		resp:    respc,
+	}
+
+	err := <-respc
+	if errors.Is(err, ErrNoAccess) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	} else if errors.Is(err, ErrNotTrash) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Undefined error", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error serving note form restore request", "err", err)
+		return
+	}
+
+	http.Redirect(w, r, "/~"+user+"/"+note, http.StatusSeeOther)
+}
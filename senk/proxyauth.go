@@ -0,0 +1,64 @@
+// authentication by a trusted reverse proxy
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ProxyAuthMiddleware authenticates requests from the trusted proxies with the configured header, which
+// replaces the session from SessionRetrievalMiddleware, which must be used before. The header of requests
+// from other addresses is ignored. If enabled, users who don't exist yet are created with their storage.
+func (db *Database) ProxyAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := GetConfig().ProxyAuth
+		if config.Header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		username := strings.ToLower(strings.TrimSpace(r.Header.Get(config.Header)))
+		if username == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !config.Trusts(r.RemoteAddr) {
+			slog.DebugContext(r.Context(), "Ignoring the authentication header from an untrusted address", "remote", r.RemoteAddr)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if user, err := db.Users.GetUser(username); err == nil && user.Disabled {
+			http.Error(w, ErrDisabled.Error(), http.StatusForbidden)
+			return
+		} else if errors.Is(err, ErrNotExist) {
+			if !config.CreateUsers {
+				http.Error(w, "There is no account for this user", http.StatusForbidden)
+				return
+			}
+			if err := db.ProvisionUser(username); errors.Is(err, ErrInvalidUsername) {
+				http.Error(w, "Invalid username", http.StatusForbidden)
+				return
+			} else if errors.Is(err, ErrDeleted) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			} else if err == nil {
+				db.audit(r.Context(), AuditEntry{Action: AuditUserCreate, Actor: username, Target: username, Detail: "proxy"})
+			} else if !errors.Is(err, ErrExist) { // created by a concurrent request
+				slog.ErrorContext(r.Context(), "Error creating user", "username", username, "err", err)
+				http.Error(w, "Undefined error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		session := Session{
+			Created:    time.Now(),
+			LastActive: time.Now(),
+			Data:       SessionData{Authenticated: true, Username: username},
+		}
+		next.ServeHTTP(w, r.WithContext(withSession(r.Context(), "", session)))
+	})
+}
@@ -0,0 +1,242 @@
+// scheduled, encrypted backups with retention
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+)
+
+const (
+	backupFilePrefix = "senk-backup-"
+	backupFileSuffix = ".tar.gz.age"
+	backupTimeFormat = "20060102-150405"
+)
+
+// BackupStats describes the results of the scheduled backups since the server started.
+type BackupStats struct {
+	Successes    uint64
+	Failures     uint64
+	LastSuccess  time.Time
+	LastDuration time.Duration
+	LastError    string
+}
+
+// BackupSchedule periodically writes encrypted backups into a directory and prunes old ones.
+type BackupSchedule struct {
+	Dir       string
+	Interval  time.Duration
+	Recipient age.Recipient
+
+	// Number of the most recent days, weeks and months for which the newest backup is kept.
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+
+	mu      sync.Mutex
+	running bool
+	last    time.Time // time of the newest backup
+	stats   BackupStats
+}
+
+// NewBackupSchedule returns nil if scheduled backups are disabled, that is if the directory isn't set.
+// The config must be validated.
+func NewBackupSchedule(config BackupConfig) (*BackupSchedule, error) {
+	if config.Dir == "" {
+		return nil, nil
+	}
+	s := &BackupSchedule{
+		Dir:         config.Dir,
+		Interval:    config.Interval.Duration,
+		KeepDaily:   config.KeepDaily,
+		KeepWeekly:  config.KeepWeekly,
+		KeepMonthly: config.KeepMonthly,
+	}
+
+	var err error
+	if config.Recipient != "" {
+		if s.Recipient, err = age.ParseX25519Recipient(config.Recipient); err != nil {
+			return nil, fmt.Errorf("invalid backup recipient: %w", err)
+		}
+	} else if s.Recipient, err = age.NewScryptRecipient(config.Passphrase); err != nil {
+		return nil, fmt.Errorf("invalid backup passphrase: %w", err)
+	}
+
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, err
+	}
+	backups, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) > 0 {
+		s.last = backups[0]
+	}
+	return s, nil
+}
+
+// list returns the times of the backups in the directory, newest first.
+func (s *BackupSchedule) list() ([]time.Time, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	times := []time.Time{}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, backupFilePrefix) || !strings.HasSuffix(name, backupFileSuffix) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, name[len(backupFilePrefix):len(name)-len(backupFileSuffix)], time.Local)
+		if err != nil {
+			continue
+		}
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	return times, nil
+}
+
+func (s *BackupSchedule) path(t time.Time) string {
+	return filepath.Join(s.Dir, backupFilePrefix+t.Format(backupTimeFormat)+backupFileSuffix)
+}
+
+// Stats returns the results of the backups.
+func (s *BackupSchedule) Stats() BackupStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Run starts a backup in the background if one is due and none is running. It is called by the periodic ticker.
+func (s *BackupSchedule) Run(db *Database, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running || now.Before(s.last.Add(s.Interval)) {
+		return
+	}
+	s.running = true
+
+	go func() {
+		start := time.Now()
+		err := s.backup(db, now)
+		duration := time.Since(start)
+
+		s.mu.Lock()
+		s.running = false
+		if err != nil {
+			s.stats.Failures++
+			s.stats.LastError = err.Error()
+			s.mu.Unlock()
+			slog.Error("Scheduled backup failed", "err", err)
+			return
+		}
+		s.last = now
+		s.stats.Successes++
+		s.stats.LastSuccess = now
+		s.stats.LastDuration = duration
+		s.stats.LastError = ""
+		s.mu.Unlock()
+		slog.Info("Scheduled backup finished", "duration", duration)
+
+		if err := s.prune(); err != nil {
+			slog.Error("Failed to prune old backups", "err", err)
+		}
+	}()
+}
+
+// backup writes an encrypted backup into a temporary file, which is renamed once it's complete.
+func (s *BackupSchedule) backup(db *Database, now time.Time) error {
+	f, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+	defer f.Close()
+
+	w, err := age.Encrypt(f, s.Recipient)
+	if err != nil {
+		return err
+	}
+	if err := db.Backup(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(now))
+}
+
+// prune removes the backups which aren't the newest of one of the most recent KeepDaily days,
+// KeepWeekly weeks or KeepMonthly months. The newest backup is never removed.
+func (s *BackupSchedule) prune() error {
+	backups, err := s.list()
+	if err != nil {
+		return err
+	}
+
+	days, weeks, months := make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	keep := func(periods map[string]bool, period string, limit int) bool {
+		if periods[period] || len(periods) >= limit {
+			return false
+		}
+		periods[period] = true
+		return true
+	}
+
+	for i, t := range backups {
+		year, week := t.ISOWeek()
+		kept := keep(days, t.Format("2006-01-02"), s.KeepDaily)
+		kept = keep(weeks, fmt.Sprintf("%d-%02d", year, week), s.KeepWeekly) || kept
+		kept = keep(months, t.Format("2006-01"), s.KeepMonthly) || kept
+		if kept || i == 0 {
+			continue
+		}
+		if err := os.Remove(s.path(t)); err != nil {
+			return err
+		}
+		slog.Info("Removed old backup", "file", filepath.Base(s.path(t)))
+	}
+	return nil
+}
+
+// decryptBackup decrypts the archive with the identities from the file or, if it's empty,
+// with the configured backup passphrase.
+func decryptBackup(r io.Reader, identityFile string) (io.Reader, error) {
+	var identities []age.Identity
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if identities, err = age.ParseIdentities(f); err != nil {
+			return nil, err
+		}
+	} else if passphrase := GetConfig().Backup.Passphrase; passphrase != "" {
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	} else {
+		return nil, errors.New("the archive is encrypted, provide an identity file or set the backup passphrase")
+	}
+	return age.Decrypt(r, identities...)
+}
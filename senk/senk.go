@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -15,92 +21,267 @@ import (
 func main() {
 	// Load configuration and database
 
-	dbPath := os.Getenv("SENK_DIR")
-	if dbPath == "" {
-		log.Fatalf("Environment variable SENK_DIR must point to the data directory.")
+	configPath := flag.String("config", os.Getenv("SENK_CONFIG"), "path to the TOML config file (env SENK_CONFIG)")
+	flag.String("dir", "", "data directory (overrides the config and SENK_DIR)")
+	flag.String("addr", "", "address to listen on (overrides the config and SENK_ADDR)")
+	flag.String("save-interval", "", "how often the database is saved, for example \"30s\"")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage+"\nFlags:\n")
+		flag.PrintDefaults()
 	}
-	err := os.MkdirAll(dbPath, 0700)
+	flag.Parse()
+	if flag.Arg(0) == "help" {
+		os.Exit(runCommand("", flag.Args()))
+	}
+
+	config, err := LoadConfig(*configPath, flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	SetConfig(config)
+
+	err = os.MkdirAll(config.Dir, 0700)
 	if err != nil {
 		log.Fatalf("Failed to initialize data directory: %v", err)
 	}
 
-	db, err := LoadDatabase(dbPath)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(config.Dir, flag.Args()))
+	}
+
+	SetupLogging(config.Log)
+
+	// Held until the server stops, so that commands don't modify the data meanwhile.
+	unlock, err := lockDir(config.Dir)
+	if err != nil {
+		fatal("Failed to lock the data directory", "err", err)
+	}
+
+	db, err := LoadDatabase(config.Dir)
 	if err != nil {
-		log.Fatalf("Failed to load database: %v", err)
+		fatal("Failed to load database", "err", err)
 	}
 
-	addr := os.Getenv("SENK_ADDR")
-	if addr == "" {
-		addr = ":3000"
-		log.Printf("Use the SENK_ADDR environment variable to set the address for the server to listen on. Using the default value: %s", addr)
+	backups, err := NewBackupSchedule(config.Backup)
+	if err != nil {
+		fatal("Invalid backup configuration", "err", err)
+	}
+
+	tlsConfig, err := NewTLSConfig(config.TLS, config.Dir)
+	if err != nil {
+		fatal("Invalid TLS configuration", "err", err)
+	}
+	if tlsConfig == nil && !config.TLS.InsecureCookies {
+		slog.Warn("Serving plain HTTP. Signing in requires a reverse proxy which terminates TLS, or tls.insecure_cookies for development on localhost.")
+	}
+
+	activated, err := SystemdListeners()
+	if err != nil {
+		fatal("Failed to use the sockets passed by systemd", "err", err)
+	}
+	listener := activatedListener(activated, RedirectSocketName, false)
+	if listener == nil {
+		listener, err = Listen(config.Addr, config)
+		if err != nil {
+			fatal("Failed to listen", "addr", config.Addr, "err", err)
+		}
+	}
+	var redirectListener net.Listener
+	if tlsConfig != nil {
+		redirectListener = activatedListener(activated, RedirectSocketName, true)
+		if redirectListener == nil && config.TLS.RedirectAddr != "" {
+			redirectListener, err = Listen(config.TLS.RedirectAddr, config)
+			if err != nil {
+				fatal("Failed to listen", "addr", config.TLS.RedirectAddr, "err", err)
+			}
+		}
 	}
 
 	// Background tasks
 
-	ticker := time.NewTicker(time.Minute)
+	ticker := time.NewTicker(config.SaveInterval.Duration)
 	go func() {
-		for range ticker.C {
+		for now := range ticker.C {
 			err := db.Save()
 			if err != nil {
-				log.Printf("Failed to periodically save database.")
+				slog.Error("Failed to periodically save database", "err", err)
 			}
+			if backups != nil {
+				backups.Run(db, now)
+			}
+			db.PurgeDeletedUsers(now)
+		}
+	}()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			next, err := LoadConfig(*configPath, flag.CommandLine)
+			if err != nil {
+				slog.Error("Failed to reload configuration, keeping the current one", "err", err)
+				continue
+			}
+			if ignored := GetConfig().Reload(next); len(ignored) > 0 {
+				slog.Warn("Changes to some settings require a restart", "settings", strings.Join(ignored, ", "))
+			}
+			ticker.Reset(GetConfig().SaveInterval.Duration)
+			level, _ := parseLogLevel(GetConfig().Log.Level)
+			logLevel.Set(level)
+			slog.Info("Configuration reloaded")
 		}
 	}()
 
 	db.StartStorageWorker()
+	ready.Store(true)
 
-	// TODO: for testing:
-	log.Println(db.Users.AddUser("teus2", "VeryStrongP@ssword123Wtf#"))
+	if len(db.Users.GetAllUsers()) == 0 {
+		slog.Warn("There are no users, create an administrator with \"senk admin -create <username>\"")
+	}
 
 	// Routes
 
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestID)
+	r.Use(AuditMiddleware)
 	r.Use(db.Sessions.SessionRetrievalMiddleware)
+	r.Use(db.ProxyAuthMiddleware)
+	r.Use(db.TokenAuthMiddleware)
+	r.Use(RequestLogger)
+	r.Use(MetricsMiddleware)
+	r.Use(CSRFMiddleware)
+	r.Use(SecurityHeaders)
 
 	r.Post("/session/signin", db.signIn)
+	r.Get("/session/2fa", db.serveSecondFactor)
+	r.Post("/session/2fa", db.verifySecondFactor)
+	if oidcAuth := NewOIDC(config.OIDC); oidcAuth != nil {
+		r.Get("/session/oidc/login", db.oidcSignIn(oidcAuth))
+		r.Get("/session/oidc/callback", db.oidcCallback(oidcAuth))
+	}
 	r.Post("/session/signout", db.signOut)
 
-	r.Get("/", db.serveMain)
-	r.Get("/app.js", serveStatic("app.js", "text/javascript"))
-	r.Get("/style.css", serveStatic("style.css", "text/css"))
+	r.Get("/", db.serveIndexPage)
+	r.Get("/app.js", serveStatic("app.js", "text/javascript; charset=utf-8"))
+	r.Get("/style.css", serveStatic("style.css", "text/css; charset=utf-8"))
+
+	r.Route("/account", func(r chi.Router) {
+		r.Get("/", db.serveAccountPage)
+		r.Post("/tokens", db.createToken)
+		r.Post("/tokens/{token}/revoke", db.revokeToken)
+		r.Post("/2fa/setup", db.totpAction(db.beginTOTP))
+		r.Post("/2fa/confirm", db.totpAction(db.Users.ConfirmTOTP))
+		r.Post("/2fa/recovery", db.totpAction(db.Users.NewRecoveryCodes))
+		r.Post("/2fa/disable", db.totpAction(db.disableTOTP))
+		r.Post("/delete", db.deleteAccount)
+	})
 
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/index", db.getIndex)
 		r.Get("/index/{user:~[a-z][a-z0-9_-]+}", db.getIndex)
 		r.Get("/trash", db.getTrash)
+		r.Get("/tags", db.getTags)
+		r.Get("/tags/{user:~[a-z][a-z0-9_-]+}", db.getTags)
+		r.Post("/tags/rename", db.renameTag)
+		r.Get("/graph", db.getGraph)
+		r.Get("/graph/{user:~[a-z][a-z0-9_-]+}", db.getGraph)
+		r.Get("/folders", db.getFolders)
+		r.Post("/folders", db.createFolder)
+		r.Get("/folders/{user:~[a-z][a-z0-9_-]+}", db.getFolders)
+		r.Put("/folders/{user:~[a-z][a-z0-9_-]+}/{folder}", db.updateFolder)
+		r.Delete("/folders/{user:~[a-z][a-z0-9_-]+}/{folder}", db.deleteFolder)
 		r.Post("/new", db.createNote)
+		r.Get("/export", db.exportNotes)
+		r.Post("/import", db.importNotes)
+		r.Get("/audit", db.getOwnAudit)
 	})
 
+	r.Get("/healthz", healthz)
+	r.Get("/readyz", readyz)
+	r.Route("/admin", func(r chi.Router) {
+		r.Get("/", db.serveAdminPage)
+		r.Get("/status", db.status)
+		r.Get("/audit", db.getAudit)
+		r.Post("/backup", db.backup)
+		r.Post("/users", db.adminAction(db.adminCreateUser))
+		r.Post("/users/{username}/password", db.adminAction(db.adminResetPassword))
+		r.Post("/users/{username}/role", db.adminAction(db.adminSetRole))
+		r.Post("/users/{username}/disable", db.adminAction(db.adminSetDisabled(true)))
+		r.Post("/users/{username}/enable", db.adminAction(db.adminSetDisabled(false)))
+		r.Post("/users/{username}/signout", db.adminAction(db.adminSignOut))
+		r.Post("/users/{username}/oidc", db.adminAction(db.adminLinkOIDC))
+		r.Post("/users/{username}/delete", db.adminAction(db.adminDeleteUser))
+	})
+
+	var metrics *http.Server
+	if config.Metrics.Addr != "" {
+		metrics = &http.Server{Handler: MetricsHandler(db, backups, config.Metrics.Token)}
+		l, err := Listen(config.Metrics.Addr, config)
+		if err != nil {
+			fatal("Failed to listen", "addr", config.Metrics.Addr, "err", err)
+		}
+		go func() {
+			if err := metrics.Serve(l); err != http.ErrServerClosed {
+				slog.Error("Failed to serve metrics", "err", err)
+			}
+		}()
+	} else if config.Metrics.Token != "" {
+		r.Method(http.MethodGet, "/metrics", MetricsHandler(db, backups, config.Metrics.Token))
+	}
+
 	r.Route("/trash", func(r chi.Router) {
-		r.Get("/", db.serveMain)
-		r.Get("/{user:~[a-z][a-z0-9_-]+}/{id}", db.serveMain)
+		r.Get("/", db.serveTrashPage)
+		r.Get("/{user:~[a-z][a-z0-9_-]+}/{id}", db.serveNotePage(true))
 		r.Get("/{user:~[a-z][a-z0-9_-]+}/{id}/raw", db.readTrashNote)
+		r.Post("/{user:~[a-z][a-z0-9_-]+}/{id}/restore", db.restoreNoteForm)
 	})
 
 	r.Route("/{user:~[a-z][a-z0-9_-]+}", func(r chi.Router) {
-		r.Get("/", db.serveMain) // TODO: for anonymous users
+		r.Get("/", db.serveIndexPage)
 		r.Route("/{id}", func(r chi.Router) {
 			r.Get("/raw", db.readNote)
-			r.Get("/", db.serveMain) // TODO: for anonymous users
+			r.Get("/html", db.renderNote)
+			r.Get("/", db.serveNote)
 			r.Put("/", db.writeNote)
+			r.Post("/", db.saveNoteForm)
 			r.Delete("/", db.deleteNote)
+			r.Post("/delete", db.deleteNoteForm)
+			r.Put("/tags", db.setTags)
+			r.Put("/permissions", db.setNotePermissions)
+			r.Put("/folder", db.moveNote)
+			r.Get("/backlinks", db.getBacklinks)
+			r.Get("/files", db.getAttachments)
+			r.Get("/files/{name}", db.readAttachment)
+			r.Post("/files/{name}", db.uploadAttachment)
+			r.Delete("/files/{name}", db.deleteAttachment)
 		})
 	})
 
 	// Server
 
 	server := http.Server{
-		Addr:    addr,
-		Handler: r,
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+
+	var redirect *http.Server
+	if redirectListener != nil {
+		redirect = NewRedirectServer(config.Addr)
+		go func() {
+			if err := redirect.Serve(redirectListener); err != http.ErrServerClosed {
+				slog.Error("Failed to serve HTTPS redirects", "err", err)
+			}
+		}()
 	}
 
 	// Cleanup
 
 	cleanup := func() {
-		log.Printf("Cleaning up...")
+		slog.Info("Cleaning up")
 		ticker.Stop()
 		_ = db.Save()
+		_ = db.auditLog.Close()
+		unlock()
 	}
 
 	closed := make(chan struct{})
@@ -109,12 +290,19 @@ func main() {
 		signal.Notify(sigint, os.Interrupt)
 		<-sigint
 
-		log.Printf("Process interrupted, shutting down the server.")
+		slog.Info("Process interrupted, shutting down the server")
+		ready.Store(false)
 
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 		defer cancel()
 		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("Error when shutting down the server: %v", err)
+			slog.Error("Error when shutting down the server", "err", err)
+		}
+		if redirect != nil {
+			_ = redirect.Shutdown(ctx)
+		}
+		if metrics != nil {
+			_ = metrics.Shutdown(ctx)
 		}
 
 		cleanup()
@@ -124,14 +312,19 @@ func main() {
 
 	// Serving
 
-	log.Printf("Starting the server.")
+	slog.Info("Starting the server", "addr", listener.Addr().String())
 
-	if err = server.ListenAndServe(); err != http.ErrServerClosed {
+	if tlsConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
 		cleanup()
-		log.Fatalf("Failed to ListenAndServer: %v", err)
+		fatal("Failed to serve", "err", err)
 	}
 
 	<-closed
 
-	log.Printf("Finished cleaning up.")
+	slog.Info("Finished cleaning up")
 }
@@ -8,17 +8,19 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
 	"time"
 )
 
-const (
-	SessionIdleTimeout     = time.Hour * 24 * 90  // remember session for 90 days
-	SessionAbsoluteTimeout = time.Hour * 24 * 365 // require the user to reauthenticate every 365 days
-	SessionCookieName      = "id"
-)
+const SessionCookieName = "id"
+
+// PendingSessionTimeout limits the time between entering the password and the second factor.
+const PendingSessionTimeout = 5 * time.Minute
+
+// PendingSessionAttempts limits the number of second factor codes which can be tried with a pending session.
+const PendingSessionAttempts = 5
 
 var (
 	ErrSessionInvalid = errors.New("session does not exist")
@@ -26,7 +28,10 @@ var (
 
 type SessionData struct {
 	Authenticated bool
-	Username      string // only makes sense if Authenticated == true
+	Username      string // only makes sense if Authenticated or Pending == true
+	Pending       bool   // the password was verified, but the second factor wasn't yet
+	Attempts      int    // number of invalid second factor codes
+	Redirect      string // where to go once the second factor is verified
 }
 
 type Session struct {
@@ -36,7 +41,11 @@ type Session struct {
 }
 
 func (s *Session) IsExpired() bool {
-	return time.Now().Sub(s.LastActive) >= SessionIdleTimeout || time.Now().Sub(s.Created) >= SessionAbsoluteTimeout
+	if s.Data.Pending && time.Now().Sub(s.Created) >= PendingSessionTimeout {
+		return true
+	}
+	timeouts := GetConfig().Session
+	return time.Now().Sub(s.LastActive) >= timeouts.IdleTimeout.Duration || time.Now().Sub(s.Created) >= timeouts.AbsoluteTimeout.Duration
 }
 
 type Sessions struct {
@@ -57,13 +66,13 @@ func (sessions *Sessions) NewSession() string {
 
 	id := make([]byte, 64)
 	if _, err := io.ReadFull(rand.Reader, id); err != nil {
-		log.Printf("Error reading from rand.Reader: %v", err)
+		slog.Error("Error reading from rand.Reader", "err", err)
 		return ""
 	}
 	strid := base64.URLEncoding.EncodeToString(id)
 
 	if _, ok := sessions.Map[strid]; ok {
-		log.Printf("Generated an already used session id!")
+		slog.Error("Generated an already used session id!")
 		return ""
 	}
 
@@ -75,7 +84,50 @@ func (sessions *Sessions) NewSession() string {
 	return strid
 }
 
-// TODO: Invalidate all sessions of a given user
+// CountActive returns the number of sessions which haven't expired.
+func (sessions *Sessions) CountActive() (authenticated, anonymous int) {
+	sessions.mu.RLock()
+	defer sessions.mu.RUnlock()
+	for _, s := range sessions.Map {
+		if s.IsExpired() {
+			continue
+		}
+		if s.Data.Authenticated {
+			authenticated++
+		} else {
+			anonymous++
+		}
+	}
+	return
+}
+
+// CountUserSessions returns the number of sessions which haven't expired, indexed by the username.
+// Pending sessions are included.
+func (sessions *Sessions) CountUserSessions() map[string]int {
+	sessions.mu.RLock()
+	defer sessions.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, s := range sessions.Map {
+		if (s.Data.Authenticated || s.Data.Pending) && !s.IsExpired() {
+			counts[s.Data.Username]++
+		}
+	}
+	return counts
+}
+
+// InvalidateUserSessions signs the user out everywhere and returns the number of removed sessions.
+func (sessions *Sessions) InvalidateUserSessions(username string) int {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	n := 0
+	for id, s := range sessions.Map {
+		if (s.Data.Authenticated || s.Data.Pending) && s.Data.Username == username {
+			delete(sessions.Map, id)
+			n++
+		}
+	}
+	return n
+}
 
 func (sessions *Sessions) InvalidateSession(id string) {
 	sessions.mu.Lock()
@@ -111,8 +163,7 @@ func (sessions *Sessions) SessionRetrievalMiddleware(next http.Handler) http.Han
 				} else {
 					session.LastActive = time.Now()
 					sessions.Map[cookie.Value] = session
-					r = r.WithContext(context.WithValue(r.Context(), ContextKey("session"), session))
-					r = r.WithContext(context.WithValue(r.Context(), ContextKey("sessionId"), cookie.Value))
+					r = r.WithContext(withSession(r.Context(), cookie.Value, session))
 				}
 			}
 			sessions.mu.Unlock()
@@ -121,6 +172,13 @@ func (sessions *Sessions) SessionRetrievalMiddleware(next http.Handler) http.Han
 	})
 }
 
+// withSession returns a context with the session, which can be retrieved with GetSessionCtx. The id is empty
+// if the session isn't stored, because the request is authenticated in another way.
+func withSession(ctx context.Context, id string, session Session) context.Context {
+	ctx = context.WithValue(ctx, ContextKey("session"), session)
+	return context.WithValue(ctx, ContextKey("sessionId"), id)
+}
+
 // GetSessionCtx retrieves the session data from the given context
 // and returns the id and session struct.
 func GetSessionCtx(ctx context.Context) (string, Session) {
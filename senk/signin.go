@@ -3,63 +3,155 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 )
 
+// startSession replaces the request's session with a new one with the data and sets the cookie.
+func (db *Database) startSession(w http.ResponseWriter, r *http.Request, data SessionData) bool {
+	sid, _ := GetSessionCtx(r.Context())
+	if sid != "" {
+		db.Sessions.InvalidateSession(sid)
+	}
+	sid = db.Sessions.NewSession()
+	err := db.Sessions.ModifySessionData(sid, data)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Modifying a new session failed", "err", err)
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    sid,
+		Path:     "/",
+		Secure:   secureCookies(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(GetConfig().Session.AbsoluteTimeout.Seconds()),
+	})
+	return true
+}
+
+// clearSessionCookie removes the cookie set by startSession, which requires the same path.
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Secure:   secureCookies(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	})
+}
+
 // TODO: Rate limiting
 func (db *Database) signIn(w http.ResponseWriter, r *http.Request) {
+	if GetConfig().OIDC.DisablePassword {
+		http.Error(w, "Signing in with a password is disabled", http.StatusForbidden)
+		return
+	}
 	username := r.PostFormValue("username")
 	password := r.PostFormValue("password")
 	if username != "" && password != "" {
 		if db.Users.CheckPassword(username, password) {
-			sid, _ := GetSessionCtx(r.Context())
-			if sid != "" {
-				db.Sessions.InvalidateSession(sid)
+			if db.Users.HasTOTP(username) {
+				// The session is only authenticated once the second factor is verified.
+				if !db.startSession(w, r, SessionData{Username: username, Pending: true, Redirect: localRedirect(r, r.Referer())}) {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Header().Add("Location", "/session/2fa")
+				w.WriteHeader(http.StatusFound)
+				return
 			}
-			sid = db.Sessions.NewSession()
-			err := db.Sessions.ModifySessionData(sid, SessionData{
-				Authenticated: true,
-				Username:      username,
-			})
-			if err != nil {
-				log.Printf("Modifying a new session failed: %v", err)
+			signIns.WithLabelValues("success").Inc()
+			db.audit(r.Context(), AuditEntry{Action: AuditSignIn, Actor: username, Target: username, Detail: "password"})
+			if !db.startSession(w, r, SessionData{Authenticated: true, Username: username}) {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			http.SetCookie(w, &http.Cookie{
-				Name:     SessionCookieName,
-				Value:    sid,
-				Path:     "/",
-				Secure:   true,
-				HttpOnly: true,
-				SameSite: http.SameSiteLaxMode,
-				MaxAge:   int(SessionAbsoluteTimeout.Seconds()),
-			})
-			w.Header().Add("Location", r.Referer())
+			w.Header().Add("Location", localRedirect(r, r.Referer()))
 			w.WriteHeader(http.StatusFound)
 			return
 		}
 	}
+	signIns.WithLabelValues("failure").Inc()
+	db.audit(r.Context(), AuditEntry{Action: AuditSignInFailed, Target: username, Detail: "password"})
 	w.WriteHeader(http.StatusForbidden) // TODO: Show more than a blank page
 }
 
+// renderSecondFactor renders the form for the second factor, with the error message if it isn't empty.
+func renderSecondFactor(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, "twofactor.html", message); err != nil {
+		slog.Error("Error executing second factor template", "err", err)
+	}
+}
+
+// serveSecondFactor serves the form for the second factor, if the password was already verified.
+func (db *Database) serveSecondFactor(w http.ResponseWriter, r *http.Request) {
+	_, session := GetSessionCtx(r.Context())
+	if !session.Data.Pending {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	renderSecondFactor(w, http.StatusOK, "")
+}
+
+// verifySecondFactor completes signing in with the "code" form value, which can be a TOTP code or a recovery code.
+func (db *Database) verifySecondFactor(w http.ResponseWriter, r *http.Request) {
+	sid, session := GetSessionCtx(r.Context())
+	if !session.Data.Pending {
+		http.Error(w, "Sign in with the password first", http.StatusForbidden)
+		return
+	}
+
+	if err := db.Users.CheckSecondFactor(session.Data.Username, r.PostFormValue("code")); errors.Is(err, ErrTOTPLocked) {
+		signIns.WithLabelValues("failure").Inc()
+		renderSecondFactor(w, http.StatusTooManyRequests, "Too many invalid codes, try again later")
+		return
+	} else if err != nil {
+		signIns.WithLabelValues("failure").Inc()
+		db.audit(r.Context(), AuditEntry{Action: AuditSignInFailed, Target: session.Data.Username, Detail: "totp"})
+		session.Data.Attempts++
+		if session.Data.Attempts >= PendingSessionAttempts {
+			db.Sessions.InvalidateSession(sid)
+			http.Error(w, "Too many invalid codes, sign in again", http.StatusForbidden)
+			return
+		}
+		_ = db.Sessions.ModifySessionData(sid, session.Data)
+		renderSecondFactor(w, http.StatusForbidden, "Invalid code")
+		return
+	}
+
+	signIns.WithLabelValues("success").Inc()
+	db.audit(r.Context(), AuditEntry{Action: AuditSignIn, Actor: session.Data.Username, Target: session.Data.Username, Detail: "totp"})
+	if !db.startSession(w, r, SessionData{Authenticated: true, Username: session.Data.Username}) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	redirect := session.Data.Redirect
+	if redirect == "" {
+		redirect = "/"
+	}
+	w.Header().Add("Location", redirect)
+	w.WriteHeader(http.StatusFound)
+}
+
 func (db *Database) signOut(w http.ResponseWriter, r *http.Request) {
-	sid, _ := GetSessionCtx(r.Context())
+	sid, session := GetSessionCtx(r.Context())
 	if sid == "" {
 		w.WriteHeader(http.StatusNotFound) // TODO: status
 		return
 	}
 	db.Sessions.InvalidateSession(sid)
-	http.SetCookie(w, &http.Cookie{
-		Name:     SessionCookieName,
-		Value:    "",
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		MaxAge:   -1,
-	})
+	if session.Data.Authenticated {
+		db.audit(r.Context(), AuditEntry{Action: AuditSignOut, Target: session.Data.Username})
+	}
+	clearSessionCookie(w, r)
 
-	w.Header().Add("Location", r.Referer())
+	w.Header().Add("Location", localRedirect(r, r.Referer()))
 	w.WriteHeader(http.StatusFound)
 }
@@ -0,0 +1,177 @@
+// health checks and server status
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// version can be set when building, with -ldflags "-X main.version=...". Otherwise it's taken from the build info.
+var version = ""
+
+// started is when the process started, for reporting the uptime.
+var started = time.Now()
+
+// ready is true once the database is loaded and the storage worker is running, until the server starts shutting down.
+var ready atomic.Bool
+
+type Status struct {
+	Version        string
+	Started        time.Time
+	Uptime         string
+	LastSave       *time.Time // nil if the database wasn't saved since the server started
+	StorageBacklog int64      // operations waiting for the storage worker
+	Disk           DiskStatus
+}
+
+type DiskStatus struct {
+	Path      string // data directory
+	DataBytes int64  // size of the files in the data directory
+	FreeBytes uint64 // available to the server on the file system of the data directory
+	SizeBytes uint64 // total size of the file system
+}
+
+// buildVersion returns the version set when building, the module version or the vcs revision.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
+// dirSizeCacheDuration limits how often the directories are walked to measure their size.
+const dirSizeCacheDuration = 5 * time.Minute
+
+// dirSizes caches the sizes of directories, for the metrics, the status and the admin page.
+type dirSizes struct {
+	mu    sync.Mutex
+	sizes map[string]int64 // indexed by the path
+	taken time.Time
+}
+
+// get returns the size of the directory. All sizes are measured again once the cached ones are
+// too old, directories which aren't cached yet are measured right away.
+func (c *dirSizes) get(dir string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes == nil || time.Since(c.taken) >= dirSizeCacheDuration {
+		c.sizes = make(map[string]int64)
+		c.taken = time.Now()
+	}
+	size, ok := c.sizes[dir]
+	if !ok {
+		size = dirSize(dir)
+		c.sizes[dir] = size
+	}
+	return size
+}
+
+// StoreSizes returns the cached sizes of the users' stores and of "_blobs", which holds attachments.
+func (db *Database) StoreSizes() map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, store := range append(db.Users.GetAllUsernames(), "_blobs") {
+		sizes[store] = db.dirSizes.get(filepath.Join(db.storage.Root, store))
+	}
+	return sizes
+}
+
+// dirSize returns the total size of the regular files in the directory and its subdirectories.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// diskStatus returns the usage of the data directory, with its cached size.
+func (db *Database) diskStatus() (DiskStatus, error) {
+	dir := db.storage.Root
+	status := DiskStatus{Path: dir, DataBytes: db.dirSizes.get(dir)}
+	var err error
+	status.FreeBytes, status.SizeBytes, err = diskSpace(dir)
+	return status, err
+}
+
+// healthz reports that the process is alive.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyz reports whether the server is ready to serve requests.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// status reports the state of the server to administrators.
+func (db *Database) status(w http.ResponseWriter, r *http.Request) {
+	if !db.adminAuthorized(r) {
+		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	status := Status{
+		Version:        buildVersion(),
+		Started:        started,
+		Uptime:         now.Sub(started).Round(time.Second).String(),
+		StorageBacklog: db.storage.Backlog(),
+	}
+	if saved := db.LastSave(); !saved.IsZero() {
+		status.LastSave = &saved
+	}
+	var err error
+	status.Disk, err = db.diskStatus()
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		slog.ErrorContext(r.Context(), "Error reading file system statistics", "err", err)
+	}
+
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, "Couldn't marshal status", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error marshalling status", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
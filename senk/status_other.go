@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+// file system statistics aren't read on other systems
+
+package main
+
+import "errors"
+
+// diskSpace returns errors.ErrUnsupported, the file system statistics aren't available on this system.
+func diskSpace(dir string) (free, size uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
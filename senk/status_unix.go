@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+// file system statistics, on the systems where syscall has Statfs
+
+package main
+
+import "syscall"
+
+// diskSpace returns the space available to the server and the total size of the file system with the directory.
+func diskSpace(dir string) (free, size uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
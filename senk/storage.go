@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"github.com/atmatto/atylar"
+	"log/slog"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 )
 
 type Storage struct {
@@ -12,6 +15,36 @@ type Storage struct {
 
 	Reads  chan NoteRead
 	Writes chan NoteWrite
+	Tasks  chan StorageTask
+
+	pending atomic.Int64 // number of operations waiting for the worker
+}
+
+// StorageTask is an arbitrary operation on the stores, executed by the storage worker
+// so that it doesn't run concurrently with reads and writes.
+type StorageTask struct {
+	run    func(s *Storage) error
+	queued time.Time
+	resp   chan error
+}
+
+// enqueue counts an operation as waiting for the worker, until it's received.
+// It returns the time for the operation's queued field.
+func (s *Storage) enqueue() time.Time {
+	s.pending.Add(1)
+	return time.Now()
+}
+
+// Backlog returns the number of operations waiting for the worker.
+func (s *Storage) Backlog() int64 {
+	return s.pending.Load()
+}
+
+// RunStorageTask executes the function in the storage worker and waits for it to finish.
+func (db *Database) RunStorageTask(run func(s *Storage) error) error {
+	resp := make(chan error)
+	db.storage.Tasks <- StorageTask{run, db.storage.enqueue(), resp}
+	return <-resp
 }
 
 func (s *Storage) LoadAll(usernames []string) error {
@@ -25,6 +58,16 @@ func (s *Storage) LoadAll(usernames []string) error {
 	return nil
 }
 
+// AddStore initializes the store of a new user. It must be called in the storage worker.
+func (s *Storage) AddStore(username string) error {
+	store, err := atylar.New(filepath.Join(s.Root, username))
+	if err != nil {
+		return fmt.Errorf("failed to initialize note storage for user \"%s\": %v", username, err)
+	}
+	s.UserStores[username] = store
+	return nil
+}
+
 func InitStorage(path string) Storage {
 	return Storage{Root: path, UserStores: make(map[string]atylar.Store)}
 }
@@ -33,16 +76,36 @@ func (db *Database) StartStorageWorker() {
 	s := &db.storage
 	s.Reads = make(chan NoteRead)
 	s.Writes = make(chan NoteWrite)
+	s.Tasks = make(chan StorageTask)
 
 	go func() {
 		for {
 			select {
 			case read := <-s.Reads:
+				s.pending.Add(-1)
+				start := observeStorageWait("read", read.queued)
 				str, err := read.Execute(db)
+				observeStorageExec("read", start)
+				slog.DebugContext(read.ctx, "Storage read", "owner", read.owner, "id", read.id, "trash", read.fromTrash,
+					"wait", start.Sub(read.queued), "duration", time.Since(start), "err", err)
 				read.resp <- NoteReadResp{str, err}
 			case write := <-s.Writes:
+				s.pending.Add(-1)
+				start := observeStorageWait("write", write.queued)
 				err := write.Execute(db)
+				observeStorageExec("write", start)
+				slog.DebugContext(write.ctx, "Storage write", "owner", write.owner, "id", write.id, "create", write.create, "delete", write.delete,
+					"restore", write.restore, "wait", start.Sub(write.queued), "duration", time.Since(start), "err", err)
+				if err == nil {
+					db.auditNoteWrite(&write)
+				}
 				write.resp <- err
+			case task := <-s.Tasks:
+				s.pending.Add(-1)
+				start := observeStorageWait("task", task.queued)
+				err := task.run(s)
+				observeStorageExec("task", start)
+				task.resp <- err
 			}
 		}
 	}()
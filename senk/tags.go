@@ -0,0 +1,196 @@
+// note tags
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidTag = errors.New("invalid tag")
+)
+
+// Tag must start with a letter or an underscore and contain only letters, numbers, hyphens and underscores.
+var tagRules *regexp.Regexp = regexp.MustCompile(`^[\p{L}_][\p{L}\p{N}_-]*$`)
+
+// hashtagPattern matches "#tag" in note content. The first group is the character preceding
+// the hash (so that URL fragments and things like "C#" are not treated as tags), the second one
+// is the tag itself.
+var hashtagPattern *regexp.Regexp = regexp.MustCompile(`(^|[^\p{L}\p{N}_&#/])#([\p{L}_][\p{L}\p{N}_-]*)`)
+
+// NormalizeTag returns the canonical form of the tag, without the leading hash
+// and in lowercase, or an error if the tag is invalid.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	if utf8.RuneCountInString(tag) > 64 || !tagRules.MatchString(tag) {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// NormalizeTags normalizes the tags, removes duplicates and sorts them.
+func NormalizeTags(tags []string) ([]string, error) {
+	set := make(map[string]struct{})
+	for _, t := range tags {
+		n, err := NormalizeTag(t)
+		if err != nil {
+			return nil, fmt.Errorf("%w: \"%s\"", err, t)
+		}
+		set[n] = struct{}{}
+	}
+	return sortedTags(set), nil
+}
+
+func sortedTags(set map[string]struct{}) []string {
+	tags := make([]string, 0, len(set))
+	for t := range set {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// ParseHashtags returns the normalized tags used in the content as "#tag".
+func ParseHashtags(content string) []string {
+	set := make(map[string]struct{})
+	for _, m := range hashtagPattern.FindAllStringSubmatch(content, -1) {
+		if t, err := NormalizeTag(m[2]); err == nil {
+			set[t] = struct{}{}
+		}
+	}
+	return sortedTags(set)
+}
+
+// ReplaceHashtag replaces all occurrences of the hashtag "from" in the content with "to".
+// Both tags have to be normalized.
+func ReplaceHashtag(content, from, to string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range hashtagPattern.FindAllStringSubmatchIndex(content, -1) {
+		start, end := m[4], m[5] // the tag, without the hash
+		if strings.ToLower(content[start:end]) != from {
+			continue
+		}
+		b.WriteString(content[last:start])
+		b.WriteString(to)
+		last = end
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+// AllTags returns the union of the explicitly set tags and the hashtags found in the content.
+func (n *NoteMeta) AllTags() []string {
+	set := make(map[string]struct{})
+	for _, t := range n.Tags {
+		set[t] = struct{}{}
+	}
+	for _, t := range n.Hashtags {
+		set[t] = struct{}{}
+	}
+	return sortedTags(set)
+}
+
+func (n *NoteMeta) HasTag(tag string) bool {
+	for _, t := range n.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	for _, t := range n.Hashtags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTags sets the explicit tags of the note. The tags have to be normalized.
+func (m *Metadata) SetTags(user, id string, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta := m.Notes[key]
+	meta.Tags = tags
+	m.Notes[key] = meta
+}
+
+// SetHashtags sets the tags parsed from the content of the note.
+func (m *Metadata) SetHashtags(user, id string, tags []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := fmt.Sprintf("%s/%s", user, id)
+	meta := m.Notes[key]
+	meta.Hashtags = tags
+	m.Notes[key] = meta
+}
+
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// GetUserTags returns the tags used in the user's notes (excluding the trash)
+// which the accessor can see, along with the number of such notes.
+func (m *Metadata) GetUserTags(user, accessor string) []TagCount {
+	counts := make(map[string]int)
+	for _, n := range m.GetUserNotes(user) {
+		if m.GetPermissions(&n.Metadata, accessor) == PermissionNone {
+			continue
+		}
+		for _, t := range n.Metadata.AllTags() {
+			counts[t]++
+		}
+	}
+
+	tags := make([]TagCount, 0, len(counts))
+	for t, c := range counts {
+		tags = append(tags, TagCount{t, c})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags
+}
+
+// HashtaggedNotes returns the ids of the user's notes which contain the hashtag, including the trash.
+func (m *Metadata) HashtaggedNotes(user, tag string) (ids []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, n := range m.Notes {
+		owner, id, _ := strings.Cut(k, "/")
+		if owner == user && slices.Contains(n.Hashtags, tag) {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
+// RenameTag replaces the explicit tag "from" with "to" in all of the user's notes, including the trash.
+// If a note already has the tag "to", the tags are merged. The hashtags are renamed by rewriting the content.
+func (m *Metadata) RenameTag(user, from, to string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, n := range m.Notes {
+		if owner, _, _ := strings.Cut(k, "/"); owner != user {
+			continue
+		}
+		set := make(map[string]struct{})
+		renamed := false
+		for _, t := range n.Tags {
+			if t == from {
+				t = to
+				renamed = true
+			}
+			set[t] = struct{}{}
+		}
+		if renamed {
+			n.Tags = sortedTags(set)
+			m.Notes[k] = n
+		}
+	}
+}
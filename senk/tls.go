@@ -0,0 +1,199 @@
+// serving https with reloadable or self-signed certificates
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate from the files, loading it again when they change.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time // modification time of the loaded files
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the certificate if the files were modified after it was loaded previously.
+// The caller must hold the lock, unless the reloader is being created.
+func (c *certReloader) reload() error {
+	var modified time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	if c.cert != nil && !modified.After(c.modified) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modified = &cert, modified
+	slog.Info("Loaded TLS certificate", "file", c.certFile)
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. If reloading fails, the previous certificate is kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if err := c.reload(); err != nil {
+			slog.Error("Error reloading TLS certificate, using the previous one", "err", err)
+		}
+	}
+	return c.cert, nil
+}
+
+// selfSignedCert returns the files of a self-signed certificate for localhost, stored in the data directory.
+// A new certificate is generated if there is none or it expires soon.
+func selfSignedCert(dir string) (certFile, keyFile string, err error) {
+	dir = filepath.Join(dir, "_tls")
+	certFile, keyFile = filepath.Join(dir, "selfsigned.crt"), filepath.Join(dir, "selfsigned.key")
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if cert, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && time.Until(cert.NotAfter) > 7*24*time.Hour {
+			return certFile, keyFile, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"senk development"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return
+	}
+	slog.Info("Generated a self-signed TLS certificate for localhost", "expires", template.NotAfter.Format("2006-01-02"))
+	return
+}
+
+// NewTLSConfig returns the configuration for serving https, or nil if it's disabled.
+func NewTLSConfig(config TLSConfig, dir string) (*tls.Config, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	certFile, keyFile := config.Cert, config.Key
+	if config.SelfSigned {
+		var err error
+		if certFile, keyFile, err = selfSignedCert(dir); err != nil {
+			return nil, fmt.Errorf("failed to generate a self-signed certificate: %w", err)
+		}
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// NewRedirectServer returns a server which redirects all requests to https on the port of httpsAddr.
+func NewRedirectServer(httpsAddr string) *http.Server {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			if host == "" {
+				http.Error(w, "Missing host", http.StatusBadRequest)
+				return
+			}
+			if port != "" && port != "443" {
+				host = net.JoinHostPort(host, port)
+			} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+				host = "[" + host + "]"
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// secureCookies returns false if the cookies may be sent without the Secure attribute, which is only the case
+// for plain http requests to localhost, when allowed in the config.
+func secureCookies(r *http.Request) bool {
+	if r.TLS != nil || !GetConfig().TLS.InsecureCookies {
+		return true
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
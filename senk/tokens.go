@@ -0,0 +1,248 @@
+// personal api tokens
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenPrefix starts every token, so that they are easy to recognize, for example by secret scanners.
+const TokenPrefix = "senk_"
+
+const (
+	ScopeRead  = "read"  // only GET and HEAD requests
+	ScopeWrite = "write" // all requests, except managing the account
+)
+
+var (
+	ErrTokenName    = errors.New("token name must have between 1 and 64 characters")
+	ErrTokenScope   = errors.New("token scope must be \"read\" or \"write\"")
+	ErrTokenNote    = errors.New("notes must be given as \"~user/id\"")
+	ErrTokenExpired = errors.New("token expiry must be in the future")
+	ErrTokenInvalid = errors.New("invalid or expired token")
+)
+
+// tokenNoteRules matches the notes which a token can be limited to.
+var tokenNoteRules *regexp.Regexp = regexp.MustCompile(`^[a-z][a-z0-9_-]+/[A-Za-z0-9_-]+$`)
+
+type Token struct {
+	Id       string // public part of the token, used to revoke it
+	Username string
+	Name     string
+	Hash     string   // hex encoded SHA-256 of the whole token
+	Scope    string   // ScopeRead or ScopeWrite
+	Notes    []string // if not empty, the token can only access these notes, as "user/id"
+	Created  time.Time
+	Expires  time.Time // zero if the token doesn't expire
+	LastUsed time.Time
+}
+
+func (t *Token) IsExpired() bool {
+	return !t.Expires.IsZero() && !time.Now().Before(t.Expires)
+}
+
+// Allows returns true if the request is within the token's scope. The permissions
+// of the token's user are checked separately, like for requests with a session.
+func (t *Token) Allows(r *http.Request) bool {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/account") || strings.HasPrefix(path, "/session/") || strings.HasPrefix(path, "/admin") {
+		return false
+	}
+	if t.Scope != ScopeWrite && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if len(t.Notes) == 0 {
+		return true
+	}
+	// The router matches escaped paths as they are, which could differ from the unescaped path checked here.
+	// Paths of notes never need escaping.
+	if !strings.HasPrefix(path, "/~") || r.URL.RawPath != "" {
+		return false
+	}
+	parts := strings.SplitN(path[len("/~"):], "/", 3)
+	return len(parts) >= 2 && slices.Contains(t.Notes, parts[0]+"/"+parts[1])
+}
+
+type Tokens struct {
+	List []Token
+	mu   sync.RWMutex
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeTokenNotes converts the notes from "~user/id" to "user/id" and removes duplicates.
+func normalizeTokenNotes(notes []string) ([]string, error) {
+	normalized := []string{}
+	for _, n := range notes {
+		n = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(n), "/"), "~")
+		if n == "" {
+			continue
+		}
+		if !tokenNoteRules.MatchString(n) {
+			return nil, ErrTokenNote
+		}
+		if !slices.Contains(normalized, n) {
+			normalized = append(normalized, n)
+		}
+	}
+	return normalized, nil
+}
+
+// Create adds a token for the user and returns it. The token itself is only returned here, only its hash is stored.
+func (tokens *Tokens) Create(username, name, scope string, notes []string, expires time.Time) (string, Token, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return "", Token{}, ErrTokenName
+	}
+	if scope != ScopeRead && scope != ScopeWrite {
+		return "", Token{}, ErrTokenScope
+	}
+	if !expires.IsZero() && !expires.After(time.Now()) {
+		return "", Token{}, ErrTokenExpired
+	}
+	notes, err := normalizeTokenNotes(notes)
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	random := make([]byte, 40)
+	if _, err := rand.Read(random); err != nil {
+		slog.Error("Error reading from rand.Reader", "err", err)
+		return "", Token{}, err
+	}
+	id := hex.EncodeToString(random[:8])
+	secret := TokenPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(random[8:])
+
+	token := Token{
+		Id:       id,
+		Username: username,
+		Name:     name,
+		Hash:     hashToken(secret),
+		Scope:    scope,
+		Notes:    notes,
+		Created:  time.Now(),
+		Expires:  expires,
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.List = append(tokens.List, token)
+	slog.Info("Created API token", "username", username, "token", id, "scope", scope)
+	return secret, token, nil
+}
+
+// GetUserTokens returns the user's tokens, including the expired ones, the newest first.
+func (tokens *Tokens) GetUserTokens(username string) []Token {
+	tokens.mu.RLock()
+	defer tokens.mu.RUnlock()
+	list := []Token{}
+	for _, t := range tokens.List {
+		if t.Username == username {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list
+}
+
+// Revoke deletes the user's token with the id.
+func (tokens *Tokens) Revoke(username, id string) error {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	for i, t := range tokens.List {
+		if t.Username == username && t.Id == id {
+			tokens.List = slices.Delete(tokens.List, i, i+1)
+			slog.Info("Revoked API token", "username", username, "token", id)
+			return nil
+		}
+	}
+	return ErrNotExist
+}
+
+// RevokeUser deletes all tokens of the user.
+func (tokens *Tokens) RevokeUser(username string) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	tokens.List = slices.DeleteFunc(tokens.List, func(t Token) bool { return t.Username == username })
+}
+
+// Authenticate returns the token if it exists and hasn't expired, and records that it was used.
+func (tokens *Tokens) Authenticate(secret string) (Token, error) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(secret, TokenPrefix), "_")
+	hash := hashToken(secret)
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	for i, t := range tokens.List {
+		if t.Id != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 || t.IsExpired() {
+			break
+		}
+		tokens.List[i].LastUsed = time.Now()
+		return tokens.List[i], nil
+	}
+	return Token{}, ErrTokenInvalid
+}
+
+// TokenAuthMiddleware authenticates requests with a token in the Authorization header. The request gets
+// a session of the token's user, like the one from SessionRetrievalMiddleware, which must be used before.
+// Requests outside of the token's scope are rejected.
+func (db *Database) TokenAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !strings.HasPrefix(secret, TokenPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := db.Tokens.Authenticate(secret)
+		if err == nil {
+			var user User
+			if user, err = db.Users.GetUser(token.Username); err == nil && user.Disabled {
+				err = ErrDisabled
+			}
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			http.Error(w, ErrTokenInvalid.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !token.Allows(r) {
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+
+		session := Session{
+			Created:    token.Created,
+			LastActive: time.Now(),
+			Data:       SessionData{Authenticated: true, Username: token.Username},
+		}
+		ctx := context.WithValue(withSession(r.Context(), "", session), ContextKey("token"), token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetTokenCtx returns the token which authenticated the request, if any.
+func GetTokenCtx(ctx context.Context) (Token, bool) {
+	t, ok := ctx.Value(ContextKey("token")).(Token)
+	return t, ok
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenAllows(t *testing.T) {
+	read := Token{Scope: ScopeRead}
+	write := Token{Scope: ScopeWrite}
+	limited := Token{Scope: ScopeWrite, Notes: []string{"alice/n1"}}
+	limitedRead := Token{Scope: ScopeRead, Notes: []string{"alice/n1"}}
+
+	tests := []struct {
+		name   string
+		token  Token
+		method string
+		target string
+		want   bool
+	}{
+		{"read get", read, http.MethodGet, "/~alice/n1", true},
+		{"read head", read, http.MethodHead, "/~alice/n1/raw", true},
+		{"read index", read, http.MethodGet, "/api/index", true},
+		{"read put", read, http.MethodPut, "/~alice/n1/", false},
+		{"read post", read, http.MethodPost, "/api/new", false},
+		{"read delete", read, http.MethodDelete, "/~alice/n1/files/a.png", false},
+		{"read trash", read, http.MethodGet, "/trash/", true},
+		{"read restore", read, http.MethodPost, "/trash/~alice/n1/restore", false},
+		{"write put", write, http.MethodPut, "/~alice/n1/", true},
+		{"write post", write, http.MethodPost, "/api/new", true},
+		{"write restore", write, http.MethodPost, "/trash/~alice/n1/restore", true},
+
+		{"account", write, http.MethodGet, "/account", false},
+		{"account tokens", write, http.MethodPost, "/account/tokens", false},
+		{"account delete", write, http.MethodPost, "/account/delete", false},
+		{"admin", write, http.MethodGet, "/admin", false},
+		{"admin audit", read, http.MethodGet, "/admin/audit", false},
+		{"admin users", write, http.MethodPost, "/admin/users/bob/role", false},
+		{"signout", write, http.MethodPost, "/session/signout", false},
+		{"signin", write, http.MethodPost, "/session/signin", false},
+		{"second factor", write, http.MethodPost, "/session/2fa", false},
+
+		{"limited note", limited, http.MethodPut, "/~alice/n1/", true},
+		{"limited note without slash", limited, http.MethodGet, "/~alice/n1", true},
+		{"limited attachment", limited, http.MethodPost, "/~alice/n1/files/a.png", true},
+		{"limited read scope", limitedRead, http.MethodPut, "/~alice/n1/", false},
+		{"limited other note", limited, http.MethodGet, "/~alice/n2", false},
+		{"limited other user", limited, http.MethodGet, "/~bob/n1", false},
+		{"limited id prefix", limited, http.MethodGet, "/~alice/n10", false},
+		{"limited user page", limited, http.MethodGet, "/~alice", false},
+		{"limited user page slash", limited, http.MethodGet, "/~alice/", false},
+		{"limited trash", limited, http.MethodGet, "/trash/", false},
+		{"limited restore", limited, http.MethodPost, "/trash/~alice/n1/restore", false},
+		{"limited api index", limited, http.MethodGet, "/api/index", false},
+		{"limited api new", limited, http.MethodPost, "/api/new", false},
+		{"limited api backlinks", limited, http.MethodGet, "/api/backlinks/~alice/n1", false},
+		{"limited root", limited, http.MethodGet, "/", false},
+		{"limited escaped slash", limited, http.MethodGet, "/~alice/n1%2F..%2F..%2F~alice%2Fn2", false},
+		{"limited escaped user", limited, http.MethodGet, "/~alice%2Fn1/n2", false},
+		{"limited account", limited, http.MethodGet, "/account", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if got := test.token.Allows(r); got != test.want {
+			t.Errorf("%s: %s %s allowed = %v, want %v", test.name, test.method, test.target, got, test.want)
+		}
+	}
+}
+
+func TestTokensAuthenticate(t *testing.T) {
+	var tokens Tokens
+	secret, created, err := tokens.Create("alice", "script", ScopeRead, nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, _, err := tokens.Create("alice", "expiring", ScopeRead, nil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := tokens.Authenticate(secret)
+	if err != nil || token.Id != created.Id {
+		t.Fatalf("valid token: got %v, %v", token.Id, err)
+	}
+	if token.LastUsed.IsZero() {
+		t.Error("LastUsed wasn't recorded")
+	}
+	if _, err := tokens.Authenticate(expiring); err != nil {
+		t.Errorf("token before its expiry: %v", err)
+	}
+
+	tokens.List[1].Expires = time.Now().Add(-time.Second)
+	if _, err := tokens.Authenticate(expiring); err != ErrTokenInvalid {
+		t.Errorf("expired token: got %v, want %v", err, ErrTokenInvalid)
+	}
+	if _, err := tokens.Authenticate(secret[:len(secret)-1] + "x"); err != ErrTokenInvalid {
+		t.Errorf("wrong secret: got %v, want %v", err, ErrTokenInvalid)
+	}
+	if _, err := tokens.Authenticate(TokenPrefix + "unknown_secret"); err != ErrTokenInvalid {
+		t.Errorf("unknown id: got %v, want %v", err, ErrTokenInvalid)
+	}
+
+	if err := tokens.Revoke("alice", created.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Authenticate(secret); err != ErrTokenInvalid {
+		t.Errorf("revoked token: got %v, want %v", err, ErrTokenInvalid)
+	}
+}
+
+func TestTokensCreate(t *testing.T) {
+	var tokens Tokens
+	tests := []struct {
+		name    string
+		scope   string
+		notes   []string
+		expires time.Time
+		want    error
+	}{
+		{"", ScopeRead, nil, time.Time{}, ErrTokenName},
+		{"script", "admin", nil, time.Time{}, ErrTokenScope},
+		{"script", ScopeRead, []string{"~alice"}, time.Time{}, ErrTokenNote},
+		{"script", ScopeRead, []string{"../alice/n1"}, time.Time{}, ErrTokenNote},
+		{"script", ScopeRead, nil, time.Now().Add(-time.Hour), ErrTokenExpired},
+		{"script", ScopeWrite, []string{"~alice/n1", "/~alice/n1", "alice/n2"}, time.Time{}, nil},
+	}
+	for _, test := range tests {
+		_, token, err := tokens.Create("alice", test.name, test.scope, test.notes, test.expires)
+		if err != test.want {
+			t.Errorf("Create(%q, %q, %q): got %v, want %v", test.name, test.scope, test.notes, err, test.want)
+		}
+		if err == nil && len(token.Notes) != 2 {
+			t.Errorf("notes weren't normalized: %q", token.Notes)
+		}
+	}
+}
+
+func TestTokenAuthMiddleware(t *testing.T) {
+	db := &Database{}
+	for _, u := range []string{"alice", "bob"} {
+		if err := db.Users.AddUser(u, "correct horse battery staple"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, _, _ := db.Tokens.Create("alice", "script", ScopeRead, nil, time.Time{})
+	bob, _, _ := db.Tokens.Create("bob", "script", ScopeWrite, nil, time.Time{})
+	expired, _, _ := db.Tokens.Create("alice", "expired", ScopeWrite, nil, time.Now().Add(time.Hour))
+	db.Tokens.List[2].Expires = time.Now().Add(-time.Second)
+	if err := db.Users.SetDisabled("bob", true); err != nil {
+		t.Fatal(err)
+	}
+
+	var username string
+	handler := db.TokenAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, session := GetSessionCtx(r.Context())
+		username = session.Data.Username
+	}))
+
+	tests := []struct {
+		name   string
+		auth   string
+		method string
+		target string
+		status int
+		user   string
+	}{
+		{"no token", "", http.MethodGet, "/api/index", http.StatusOK, ""},
+		{"other bearer token", "Bearer admin-token", http.MethodGet, "/admin/status", http.StatusOK, ""},
+		{"valid", "Bearer " + alice, http.MethodGet, "/api/index", http.StatusOK, "alice"},
+		{"out of scope", "Bearer " + alice, http.MethodPost, "/api/new", http.StatusForbidden, ""},
+		{"account", "Bearer " + alice, http.MethodGet, "/account", http.StatusForbidden, ""},
+		{"expired", "Bearer " + expired, http.MethodGet, "/api/index", http.StatusUnauthorized, ""},
+		{"invalid", "Bearer " + TokenPrefix + "0000_invalid", http.MethodGet, "/api/index", http.StatusUnauthorized, ""},
+		{"disabled user", "Bearer " + bob, http.MethodGet, "/api/index", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		username = ""
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status || username != test.user {
+			t.Errorf("%s: got status %d and user %q, want %d and %q", test.name, w.Code, username, test.status, test.user)
+		}
+	}
+
+	// enabling the user again makes the token valid
+	if err := db.Users.SetDisabled("bob", false); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/new", nil)
+	r.Header.Set("Authorization", "Bearer "+bob)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || username != "bob" {
+		t.Errorf("enabled user: got status %d and user %q", w.Code, username)
+	}
+}
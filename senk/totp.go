@@ -0,0 +1,310 @@
+// two-factor authentication with time-based one-time passwords
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"image/png"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer    = "senk"
+	totpPeriod    = 30 // seconds
+	totpSkew      = 1  // number of periods before and after the current one, for which codes are accepted
+	recoveryCodes = 10
+
+	totpFreeAttempts = 5                // failed codes in a row before codes are refused for a time
+	totpLockout      = 30 * time.Second // after totpFreeAttempts failures, doubled with every further one
+	totpMaxLockout   = time.Hour
+)
+
+var (
+	ErrTOTPEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTOTPNotStarted = errors.New("two-factor authentication setup wasn't started")
+	ErrInvalidCode    = errors.New("invalid code")
+	ErrTOTPLocked     = errors.New("too many invalid codes, try again later")
+)
+
+var totpOptions = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// TOTP is the user's second factor.
+type TOTP struct {
+	Secret        string    // base32 encoded
+	Enabled       bool      // false until the setup is confirmed with a code
+	LastStep      int64     // last period for which a code was used, so that codes can't be reused
+	RecoveryCodes []string  // hex encoded SHA-256 of the unused recovery codes
+	Failures      int       // failed codes since the last valid one, across all sign ins
+	LockedUntil   time.Time // no codes are accepted until then
+}
+
+// totpEnrollment is shown to the user when setting up the second factor.
+type totpEnrollment struct {
+	URI    string       // otpauth:// provisioning URI
+	QR     template.URL // the URI as a data: URL of a PNG QR code
+	Secret string
+}
+
+// totpBase32 encodes the secrets, like in the provisioning URI.
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPKey(username string, secret []byte) (*otp.Key, error) {
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: username,
+		Period:      totpPeriod,
+		Secret:      secret,
+		Digits:      totpOptions.Digits,
+		Algorithm:   totpOptions.Algorithm,
+	})
+}
+
+func newTOTPEnrollment(username, secret string) (totpEnrollment, error) {
+	decoded, err := totpBase32.DecodeString(secret)
+	if err != nil {
+		return totpEnrollment{}, err
+	}
+	key, err := newTOTPKey(username, decoded)
+	if err != nil {
+		return totpEnrollment{}, err
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return totpEnrollment{}, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return totpEnrollment{}, err
+	}
+	return totpEnrollment{
+		URI:    key.URL(),
+		QR:     template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())),
+		Secret: key.Secret(),
+	}, nil
+}
+
+// verifyCode checks the code against the periods around now and records the period, so that the code can't be reused.
+func (t *TOTP) verifyCode(code string, now time.Time) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	step := now.Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= t.LastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(t.Secret, time.Unix(s*totpPeriod, 0), totpOptions)
+		if err != nil {
+			slog.Error("Error generating TOTP code", "err", err)
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			t.LastStep = s
+			return true
+		}
+	}
+	return false
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode removes the recovery code if it's valid.
+func (t *TOTP) useRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for i, h := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes replaces the recovery codes and returns the new ones, formatted as "xxxxx-xxxxx".
+func (t *TOTP) newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodes)
+	t.RecoveryCodes = make([]string, recoveryCodes)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		t.RecoveryCodes[i] = hashRecoveryCode(code)
+	}
+	return codes, nil
+}
+
+// HasTOTP returns true if the user has enabled two-factor authentication.
+func (users *Users) HasTOTP(username string) bool {
+	users.mu.RLock()
+	defer users.mu.RUnlock()
+	i := users.index(username)
+	return i != -1 && users.List[i].TOTP != nil && users.List[i].TOTP.Enabled
+}
+
+// GetTOTPStatus returns whether two-factor authentication is enabled, the number of unused recovery
+// codes and, if the setup was started but not confirmed, the enrollment to show to the user.
+func (users *Users) GetTOTPStatus(username string) (enabled bool, recovery int, enrollment *totpEnrollment, err error) {
+	users.mu.RLock()
+	defer users.mu.RUnlock()
+	i := users.index(username)
+	if i == -1 {
+		return false, 0, nil, ErrNotExist
+	}
+	t := users.List[i].TOTP
+	if t == nil {
+		return false, 0, nil, nil
+	}
+	if t.Enabled {
+		return true, len(t.RecoveryCodes), nil, nil
+	}
+	e, err := newTOTPEnrollment(username, t.Secret)
+	return false, 0, &e, err
+}
+
+// BeginTOTP generates a new secret for the user, which is used once the setup is confirmed with ConfirmTOTP.
+func (users *Users) BeginTOTP(username string) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	i := users.index(username)
+	if i == -1 {
+		return ErrNotExist
+	}
+	if t := users.List[i].TOTP; t != nil && t.Enabled {
+		return ErrTOTPEnabled
+	}
+	key, err := newTOTPKey(username, nil) // random secret
+	if err != nil {
+		return err
+	}
+	users.List[i].TOTP = &TOTP{Secret: key.Secret()}
+	return nil
+}
+
+// ConfirmTOTP enables two-factor authentication if the code is valid and returns the recovery codes.
+func (users *Users) ConfirmTOTP(username, code string) ([]string, error) {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	i := users.index(username)
+	if i == -1 {
+		return nil, ErrNotExist
+	}
+	t := users.List[i].TOTP
+	if t == nil {
+		return nil, ErrTOTPNotStarted
+	}
+	if t.Enabled {
+		return nil, ErrTOTPEnabled
+	}
+	if !t.verifyCode(code, time.Now()) {
+		return nil, ErrInvalidCode
+	}
+	codes, err := t.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	t.Enabled = true
+	slog.Info("Enabled two-factor authentication", "username", username)
+	return codes, nil
+}
+
+// DisableTOTP disables two-factor authentication, or cancels its setup. The code can also be a recovery code.
+func (users *Users) DisableTOTP(username, code string) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	i := users.index(username)
+	if i == -1 {
+		return ErrNotExist
+	}
+	t := users.List[i].TOTP
+	if t == nil {
+		return ErrTOTPNotEnabled
+	}
+	if t.Enabled && !t.verifyCode(code, time.Now()) && !t.useRecoveryCode(code) {
+		return ErrInvalidCode
+	}
+	users.List[i].TOTP = nil
+	slog.Info("Disabled two-factor authentication", "username", username)
+	return nil
+}
+
+// NewRecoveryCodes replaces the user's recovery codes, if the code is valid, and returns the new ones.
+func (users *Users) NewRecoveryCodes(username, code string) ([]string, error) {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	i := users.index(username)
+	if i == -1 {
+		return nil, ErrNotExist
+	}
+	t := users.List[i].TOTP
+	if t == nil || !t.Enabled {
+		return nil, ErrTOTPNotEnabled
+	}
+	if !t.verifyCode(code, time.Now()) {
+		return nil, ErrInvalidCode
+	}
+	return t.newRecoveryCodes()
+}
+
+// fail records a failed code. After totpFreeAttempts failures in a row, codes are refused for totpLockout,
+// which is doubled with every further failure, up to totpMaxLockout.
+func (t *TOTP) fail(now time.Time) {
+	t.Failures++
+	if n := t.Failures - totpFreeAttempts; n >= 0 {
+		t.LockedUntil = now.Add(min(totpLockout<<min(n, 10), totpMaxLockout))
+	}
+}
+
+// CheckSecondFactor returns nil if the code is a valid TOTP code or an unused recovery code, which is then used up.
+// The failed codes are counted for the user, not for the sign in, so that signing in again doesn't allow more tries.
+func (users *Users) CheckSecondFactor(username, code string) error {
+	return users.checkSecondFactor(username, code, time.Now())
+}
+
+func (users *Users) checkSecondFactor(username, code string, now time.Time) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	i := users.index(username)
+	if i == -1 {
+		return ErrNotExist
+	}
+	t := users.List[i].TOTP
+	if t == nil || !t.Enabled {
+		return ErrTOTPNotEnabled
+	}
+	if now.Before(t.LockedUntil) {
+		return ErrTOTPLocked
+	}
+	if t.verifyCode(code, now) {
+		t.Failures = 0
+		return nil
+	}
+	if t.useRecoveryCode(code) {
+		t.Failures = 0
+		slog.Info("Used a recovery code", "username", username, "remaining", len(t.RecoveryCodes))
+		return nil
+	}
+	t.fail(now)
+	if t.Failures >= totpFreeAttempts {
+		slog.Warn("Too many invalid second factor codes", "username", username, "failures", t.Failures, "until", t.LockedUntil)
+	}
+	return ErrInvalidCode
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestCheckSecondFactorLockout(t *testing.T) {
+	var users Users
+	if err := users.AddUser("alice", "correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := newTOTPKey("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.List[0].TOTP = &TOTP{Secret: key.Secret(), Enabled: true}
+	code := func(now time.Time) string {
+		c, err := totp.GenerateCodeCustom(key.Secret(), now, totpOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	now := time.Now()
+	for i := 0; i < totpFreeAttempts-1; i++ {
+		if err := users.checkSecondFactor("alice", "000000", now); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d: got %v, want %v", i, err, ErrInvalidCode)
+		}
+	}
+	// a valid code resets the count
+	if err := users.checkSecondFactor("alice", code(now), now); err != nil {
+		t.Fatalf("valid code: %v", err)
+	}
+	if f := users.List[0].TOTP.Failures; f != 0 {
+		t.Fatalf("failures after a valid code: %d", f)
+	}
+
+	for i := 0; i < totpFreeAttempts; i++ {
+		if err := users.checkSecondFactor("alice", "000000", now); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("attempt %d: got %v, want %v", i, err, ErrInvalidCode)
+		}
+	}
+	// even a valid code is refused until the lockout is over
+	if err := users.checkSecondFactor("alice", code(now.Add(totpPeriod*time.Second)), now.Add(time.Second)); !errors.Is(err, ErrTOTPLocked) {
+		t.Fatalf("locked: got %v, want %v", err, ErrTOTPLocked)
+	}
+
+	// every further failure doubles the lockout
+	lockout := totpLockout
+	for i := 0; i < 10; i++ {
+		now = users.List[0].TOTP.LockedUntil
+		if err := users.checkSecondFactor("alice", "000000", now); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("after lockout %d: got %v, want %v", i, err, ErrInvalidCode)
+		}
+		lockout = min(2*lockout, totpMaxLockout)
+		if got := users.List[0].TOTP.LockedUntil.Sub(now); got != lockout {
+			t.Fatalf("lockout %d: got %v, want %v", i, got, lockout)
+		}
+	}
+
+	now = users.List[0].TOTP.LockedUntil.Add(totpPeriod * time.Second)
+	if err := users.checkSecondFactor("alice", code(now), now); err != nil {
+		t.Fatalf("valid code after the lockout: %v", err)
+	}
+	if err := users.checkSecondFactor("alice", "000000", now); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("failure after a valid code: got %v, want %v", err, ErrInvalidCode)
+	}
+}
@@ -4,10 +4,13 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/alexedwards/argon2id"
 	"github.com/nbutton23/zxcvbn-go"
-	"log"
+	"log/slog"
 	"regexp"
+	"slices"
+	"strings"
 	"sync"
 )
 
@@ -15,12 +18,19 @@ import (
 // TODO: Password hashing security
 
 var (
-	ErrPasswordLength   = errors.New("password must contain between 8 and 256 characters")
+	ErrPasswordLength   = errors.New("password is too short or too long")
 	ErrPasswordStrength = errors.New("password is too weak")
 	ErrExist            = errors.New("user already exists")
 	ErrNotExist         = errors.New("user does not exist")
 	ErrInvalidUsername  = errors.New("invalid username")
 	ErrAuthFailed       = errors.New("invalid username or password")
+	ErrInvalidRole      = errors.New("role must be \"user\" or \"admin\"")
+	ErrDisabled         = errors.New("user is disabled")
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin" // can manage users and use the admin endpoints
 )
 
 // Username must start with a lowercase letter and contain only lowercase letters, numbers, hyphens and underscores.
@@ -29,36 +39,47 @@ var usernameRules *regexp.Regexp = regexp.MustCompile("^[a-z][a-z0-9_-]+$")
 type User struct {
 	Username     string
 	PasswordHash string
+	TOTP         *TOTP  `json:",omitempty"` // nil if two-factor authentication isn't set up
+	Role         string `json:",omitempty"` // RoleUser if empty
+	Disabled     bool   `json:",omitempty"` // disabled users can't sign in or use their tokens
+	// OIDC is the identity at the identity provider which the user signs in with, nil if there is none.
+	OIDC *OIDCIdentity `json:",omitempty"`
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin && !u.Disabled
 }
 
 func (u *User) CheckPassword(password string) bool {
 	if u.PasswordHash == "" {
-		log.Printf("Tried to check the password of an unitialized user \"%s\"", u.Username)
+		// Users added by an identity provider don't have a password.
+		slog.Warn("Tried to check the password of a user without one", "username", u.Username)
 		return false
 	}
 
 	match, err := argon2id.ComparePasswordAndHash(password, u.PasswordHash)
 	if err != nil {
-		log.Printf("Error checking password for user \"%s\": %v", u.Username, err)
+		slog.Error("Error checking password", "username", u.Username, "err", err)
 		return false
 	}
 	return match
 }
 
 func (u *User) SetPassword(password string) error {
-	if len(password) < 8 || len(password) > 256 {
-		return ErrPasswordLength
-	} else if zxcvbn.PasswordStrength(password, []string{u.Username}).Score < 2 {
+	config := GetConfig()
+	if len(password) < config.Password.MinLength || len(password) > config.Password.MaxLength {
+		return fmt.Errorf("%w, it must contain between %d and %d characters", ErrPasswordLength, config.Password.MinLength, config.Password.MaxLength)
+	} else if zxcvbn.PasswordStrength(password, []string{u.Username}).Score < config.Password.MinStrength {
 		return ErrPasswordStrength
 	}
 
-	hash, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+	hash, err := argon2id.CreateHash(password, config.Argon2.Params())
 	if err != nil {
-		log.Printf("Error hashing password for user \"%s\": %v", u.Username, err)
+		slog.Error("Error hashing password", "username", u.Username, "err", err)
 		return err
 	}
 	u.PasswordHash = hash
-	log.Printf("Password set for user \"%s\"", u.Username)
+	slog.Info("Password set", "username", u.Username)
 	return nil
 }
 
@@ -75,6 +96,16 @@ type Users struct {
 	mu   sync.RWMutex
 }
 
+// index returns the index of the user in the list, or -1 if there is no such user. The caller must hold the lock.
+func (users *Users) index(username string) int {
+	for i, u := range users.List {
+		if u.Username == username {
+			return i
+		}
+	}
+	return -1
+}
+
 // GetUser returns an error if there is no user with such username.
 func (users *Users) GetUser(username string) (User, error) {
 	users.mu.RLock()
@@ -88,6 +119,21 @@ func (users *Users) GetUser(username string) (User, error) {
 	return User{}, ErrNotExist
 }
 
+// GetAllUsers returns a copy of all users, sorted by the username.
+func (users *Users) GetAllUsers() []User {
+	users.mu.RLock()
+	defer users.mu.RUnlock()
+	list := slices.Clone(users.List)
+	slices.SortFunc(list, func(a, b User) int { return strings.Compare(a.Username, b.Username) })
+	return list
+}
+
+// IsAdmin returns true if the user exists, has the admin role and isn't disabled.
+func (users *Users) IsAdmin(username string) bool {
+	u, err := users.GetUser(username)
+	return err == nil && u.IsAdmin()
+}
+
 func (users *Users) GetAllUsernames() (names []string) {
 	users.mu.RLock()
 	defer users.mu.RUnlock()
@@ -102,17 +148,15 @@ func (users *Users) CheckPassword(username string, password string) bool {
 	users.mu.RLock()
 	defer users.mu.RUnlock()
 
-	var user *User = nil
-	for _, u := range users.List {
-		if u.Username == username {
-			user = &u
-		}
+	i := users.index(username)
+	if i == -1 {
+		return false
 	}
-
-	if user != nil {
-		return user.CheckPassword(password)
+	if users.List[i].Disabled {
+		slog.Info("Disabled user tried to sign in", "username", username)
+		return false
 	}
-	return false
+	return users.List[i].CheckPassword(password)
 }
 
 // TODO: Caller has to initialize storage for the new user.
@@ -136,7 +180,26 @@ func (users *Users) AddUser(username string, password string) error {
 	}
 
 	users.List = append(users.List, u)
-	log.Printf("Added user \"%s\"", u.Username)
+	slog.Info("Added user", "username", u.Username)
+	return nil
+}
+
+// AddExternalUser adds a user without a password, who is authenticated by an identity provider.
+// The caller has to initialize storage for the new user.
+func (users *Users) AddExternalUser(username string) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+
+	if users.index(username) != -1 {
+		return ErrExist
+	}
+	u, err := NewUser(username)
+	if err != nil {
+		return err
+	}
+
+	users.List = append(users.List, u)
+	slog.Info("Added external user", "username", u.Username)
 	return nil
 }
 
@@ -162,26 +225,64 @@ func (users *Users) ChangePassword(username string, old string, new string) erro
 	}
 }
 
-func (users *Users) DeleteUser(username string) error {
+// ResetPassword sets the user's password without checking the old one.
+func (users *Users) ResetPassword(username string, password string) error {
 	users.mu.Lock()
 	defer users.mu.Unlock()
 
-	i := -1
-	for k, u := range users.List {
-		if u.Username == username {
-			i = k
-			break
-		}
+	i := users.index(username)
+	if i == -1 {
+		return ErrNotExist
+	}
+	return users.List[i].SetPassword(password)
+}
+
+func (users *Users) SetRole(username string, role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return ErrInvalidRole
+	}
+	users.mu.Lock()
+	defer users.mu.Unlock()
+
+	i := users.index(username)
+	if i == -1 {
+		return ErrNotExist
 	}
+	users.List[i].Role = role
+	slog.Info("Role set", "username", username, "role", role)
+	return nil
+}
+
+// SetDisabled disables or enables the user. The caller has to invalidate the sessions of a disabled user.
+func (users *Users) SetDisabled(username string, disabled bool) error {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+
+	i := users.index(username)
 	if i == -1 {
 		return ErrNotExist
 	}
+	users.List[i].Disabled = disabled
+	slog.Info("User disabled", "username", username, "disabled", disabled)
+	return nil
+}
+
+// DeleteUser removes the user from the list and returns them. The caller has to clean up
+// the rest of their data, which Database.DeleteUser does.
+func (users *Users) DeleteUser(username string) (User, error) {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+
+	i := users.index(username)
+	if i == -1 {
+		return User{}, ErrNotExist
+	}
+	user := users.List[i]
 
 	last := len(users.List) - 1
 	users.List[i] = users.List[last]
 	users.List = users.List[:last]
 
-	// TODO: Cleanup everything, maybe leaving some backup
-
-	return nil
+	slog.Info("Removed user", "username", username)
+	return user, nil
 }